@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+)
+
+const (
+	// cursorAuthClientID is the client id Cursor's editor uses against the
+	// token endpoint.
+	cursorAuthClientID = "KbZUR41cY7W6zRSdpSUJ7I7mLYBKOCmB"
+
+	// tokenRefreshSkew is how long before the JWT expiry we refresh, so a
+	// request started just before expiry doesn't race it.
+	tokenRefreshSkew = 5 * time.Minute
+
+	// tokenRefreshBackoff is how long a failed refresh is remembered before
+	// the next one is tried, so every request doesn't repeat it.
+	tokenRefreshBackoff = time.Minute
+)
+
+var errNoRefreshToken = errors.New("no refresh token available")
+
+// tokenManager hands out access tokens, refreshing them shortly before they
+// expire or when the server rejects them.
+type tokenManager struct {
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiry       time.Time
+
+	// refreshErr is why the last refresh failed, nil once one succeeds,
+	// and no refresh is tried again before retryAt. refreshing is closed
+	// when the refresh in flight, if any, is done.
+	refreshErr error
+	retryAt    time.Time
+	refreshing chan struct{}
+
+	refreshURL string
+	client     *http.Client
+	now        func() time.Time
+
+	// reload re-reads credentials from Cursor's own storage, used when we
+	// can't refresh ourselves but the editor may have.
+	reload func() (*cursorCredentials, error)
+}
+
+func newTokenManager(creds *cursorCredentials, refreshURL string, client *http.Client, reload func() (*cursorCredentials, error)) *tokenManager {
+	t := &tokenManager{
+		accessToken:  creds.accessToken,
+		refreshToken: creds.refreshToken,
+		refreshURL:   refreshURL,
+		client:       client,
+		now:          time.Now,
+		reload:       reload,
+	}
+
+	if exp, err := jwtExpiry(creds.accessToken); err == nil {
+		t.expiry = exp
+	} else {
+		log.Printf("unable to decode access token expiry: %v", err)
+	}
+
+	return t
+}
+
+// token returns an access token that is valid for at least tokenRefreshSkew,
+// refreshing it first if needed. If refreshing fails the old token is
+// returned and the server gets to decide.
+func (t *tokenManager) token(ctx context.Context) string {
+	t.mu.Lock()
+	token := t.accessToken
+	due := !t.expiry.IsZero() && t.now().Add(tokenRefreshSkew).After(t.expiry)
+	t.mu.Unlock()
+
+	if !due {
+		return token
+	}
+
+	if err := t.refresh(ctx, token); err != nil {
+		log.Printf("proactive token refresh failed: %v", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.accessToken
+}
+
+// invalidate forces a refresh after the server rejected the given token. It
+// is a no-op if another caller already replaced that token.
+func (t *tokenManager) invalidate(ctx context.Context, rejected string) error {
+	return t.refresh(ctx, rejected)
+}
+
+// refresh replaces stale unless that already happened. Only one refresh
+// runs at a time and callers arriving meanwhile wait for its result; after
+// a failure the next tokenRefreshBackoff gets the same error without
+// trying again. The lock isn't held over the network, so authState never
+// waits on it.
+func (t *tokenManager) refresh(ctx context.Context, stale string) error {
+	t.mu.Lock()
+
+	if t.accessToken != stale {
+		t.mu.Unlock()
+		return nil
+	}
+
+	if t.refreshing == nil && t.now().Before(t.retryAt) {
+		defer t.mu.Unlock()
+		return t.refreshErr
+	}
+
+	if done := t.refreshing; done != nil {
+		t.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		return t.refreshErr
+	}
+
+	done := make(chan struct{})
+	t.refreshing = done
+	refreshToken := t.refreshToken
+	t.mu.Unlock()
+
+	creds, err := t.renew(ctx, stale, refreshToken)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err == nil {
+		t.setLocked(creds.accessToken)
+		if creds.refreshToken != "" {
+			t.refreshToken = creds.refreshToken
+		}
+		log.Printf("refreshed access token, expires %v", t.expiry)
+		t.retryAt = time.Time{}
+	} else {
+		t.retryAt = t.now().Add(tokenRefreshBackoff)
+	}
+	t.refreshErr = err
+	t.refreshing = nil
+	close(done)
+
+	return err
+}
+
+// renew exchanges the refresh token, falling back to rereading Cursor's
+// state.
+func (t *tokenManager) renew(ctx context.Context, stale, refreshToken string) (*cursorCredentials, error) {
+	accessToken, err := t.exchange(ctx, refreshToken)
+	if err == nil {
+		return &cursorCredentials{accessToken: accessToken}, nil
+	}
+
+	log.Printf("token exchange failed, rereading cursor state: %v", err)
+
+	creds, reloadErr := t.reload()
+	if reloadErr != nil {
+		return nil, fmt.Errorf("%w (reload: %v)", err, reloadErr)
+	}
+
+	if creds.accessToken == stale {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+// authState summarises the token for status reporting: "ok", "expired"
+// once it is past its expiry, or "refresh_failed" if refreshing it last
+// failed.
+func (t *tokenManager) authState() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.refreshErr != nil:
+		return "refresh_failed"
+	case !t.expiry.IsZero() && t.now().After(t.expiry):
+		return "expired"
+	default:
+		return "ok"
+	}
+}
+
+type tokenRefreshRequest struct {
+	GrantType    string `json:"grant_type"`
+	ClientID     string `json:"client_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type tokenRefreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	ShouldLogout bool   `json:"shouldLogout"`
+}
+
+// exchange trades refreshToken for a new access token.
+func (t *tokenManager) exchange(ctx context.Context, refreshToken string) (string, error) {
+	if refreshToken == "" {
+		return "", errNoRefreshToken
+	}
+
+	body, err := json.Marshal(tokenRefreshRequest{
+		GrantType:    "refresh_token",
+		ClientID:     cursorAuthClientID,
+		RefreshToken: refreshToken,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.refreshURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error refreshing token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error refreshing token: %s", resp.Status)
+	}
+
+	var out tokenRefreshResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("error decoding token response: %w", err)
+	}
+
+	if out.ShouldLogout || out.AccessToken == "" {
+		return "", errors.New("refresh token rejected, sign in to cursor again")
+	}
+
+	return out.AccessToken, nil
+}
+
+func (t *tokenManager) setLocked(accessToken string) {
+	t.accessToken = accessToken
+	t.expiry = time.Time{}
+
+	if exp, err := jwtExpiry(accessToken); err == nil {
+		t.expiry = exp
+	}
+}
+
+// jwtExpiry decodes the exp claim of a JWT without verifying its signature.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("malformed jwt")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error decoding jwt payload: %w", err)
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("error parsing jwt claims: %w", err)
+	}
+
+	if claims.Exp == 0 {
+		return time.Time{}, errors.New("jwt has no exp claim")
+	}
+
+	return time.Unix(claims.Exp, 0), nil
+}
+
+// openStream starts a server stream and pulls its first message. Connect
+// only surfaces most errors once the stream is read, so if the first read
+// fails with Unauthenticated the token is refreshed and the stream is opened
+// once more. The returned bool reports whether a first message is available
+// via Msg.
+func openStream[Req, Res any](
+	ctx context.Context,
+	tokens *tokenManager,
+	open func(context.Context, *connect.Request[Req]) (*connect.ServerStreamForClient[Res], error),
+	build func(accessToken string) *connect.Request[Req],
+) (*connect.ServerStreamForClient[Res], bool, error) {
+	var stream *connect.ServerStreamForClient[Res]
+	var err error
+
+	for attempt := 0; attempt < 2; attempt++ {
+		token := tokens.token(ctx)
+
+		stream, err = open(ctx, build(token))
+		if err == nil {
+			if stream.Receive() {
+				return stream, true, nil
+			}
+
+			err = stream.Err()
+			if err == nil {
+				return stream, false, nil
+			}
+			stream.Close()
+		}
+
+		if attempt > 0 || connect.CodeOf(err) != connect.CodeUnauthenticated {
+			break
+		}
+
+		log.Printf("request unauthenticated, refreshing token and retrying")
+
+		if refreshErr := tokens.invalidate(ctx, token); refreshErr != nil {
+			log.Printf("error refreshing token: %v", refreshErr)
+			break
+		}
+	}
+
+	return nil, false, err
+}
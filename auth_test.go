@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+var authTestNow = time.Unix(1_700_000_000, 0)
+
+// fakeJWT builds an unsigned token expiring at exp.
+func fakeJWT(exp time.Time) string {
+	claims := base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, `{"exp":%d}`, exp.Unix()))
+	return "eyJhbGciOiJub25lIn0." + claims + ".sig"
+}
+
+// fakeAuthServer answers the token endpoint with issued, or with status if
+// it isn't 200. release, if set, holds every answer until it is closed.
+type fakeAuthServer struct {
+	*httptest.Server
+
+	issued  string
+	status  int
+	release chan struct{}
+	hits    atomic.Int32
+	got     atomic.Value
+}
+
+func newFakeAuthServer(t *testing.T, issued string) *fakeAuthServer {
+	f := &fakeAuthServer{issued: issued, status: http.StatusOK}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.hits.Add(1)
+
+		var req tokenRefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding refresh request: %v", err)
+		}
+		f.got.Store(req)
+
+		if f.release != nil {
+			<-f.release
+		}
+
+		if f.status != http.StatusOK {
+			w.WriteHeader(f.status)
+			return
+		}
+
+		json.NewEncoder(w).Encode(tokenRefreshResponse{AccessToken: f.issued})
+	}))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func newTestTokenManager(f *fakeAuthServer, accessToken string, reload func() (*cursorCredentials, error)) *tokenManager {
+	if reload == nil {
+		reload = func() (*cursorCredentials, error) {
+			return nil, errors.New("no state database")
+		}
+	}
+
+	t := newTokenManager(&cursorCredentials{accessToken: accessToken, refreshToken: "refresh"}, f.URL, f.Client(), reload)
+	t.now = func() time.Time { return authTestNow }
+
+	return t
+}
+
+func TestJWTExpiry(t *testing.T) {
+	payload := func(s string) string {
+		return "h." + base64.RawURLEncoding.EncodeToString([]byte(s)) + ".s"
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "valid", token: fakeJWT(authTestNow), want: authTestNow},
+		{name: "padded", token: "h." + base64.URLEncoding.EncodeToString([]byte(`{"exp":1700000000}`)) + ".s", want: authTestNow},
+		{name: "two parts", token: "h.s", wantErr: true},
+		{name: "bad base64", token: "h.!!!.s", wantErr: true},
+		{name: "bad json", token: payload("{"), wantErr: true},
+		{name: "no exp", token: payload(`{"sub":"x"}`), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jwtExpiry(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jwtExpiry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("jwtExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenProactiveRefresh(t *testing.T) {
+	fresh := fakeJWT(authTestNow.Add(time.Hour))
+
+	tests := []struct {
+		name     string
+		current  string
+		want     string
+		wantHits int32
+	}{
+		{name: "valid long enough", current: fakeJWT(authTestNow.Add(time.Hour)), want: "", wantHits: 0},
+		{name: "inside the skew", current: fakeJWT(authTestNow.Add(tokenRefreshSkew - time.Second)), want: fresh, wantHits: 1},
+		{name: "expired", current: fakeJWT(authTestNow.Add(-time.Minute)), want: fresh, wantHits: 1},
+		{name: "no expiry", current: "opaque", want: "", wantHits: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeAuthServer(t, fresh)
+			tokens := newTestTokenManager(f, tt.current, nil)
+
+			want := tt.want
+			if want == "" {
+				want = tt.current
+			}
+
+			if got := tokens.token(context.Background()); got != want {
+				t.Errorf("token() = %q, want %q", got, want)
+			}
+			if hits := f.hits.Load(); hits != tt.wantHits {
+				t.Errorf("token endpoint hit %d times, want %d", hits, tt.wantHits)
+			}
+			if tt.wantHits > 0 {
+				req := f.got.Load().(tokenRefreshRequest)
+				if req.GrantType != "refresh_token" || req.RefreshToken != "refresh" || req.ClientID != cursorAuthClientID {
+					t.Errorf("refresh request = %+v", req)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenRefreshFailureKeepsOldToken(t *testing.T) {
+	f := newFakeAuthServer(t, "")
+	f.status = http.StatusUnauthorized
+
+	expired := fakeJWT(authTestNow.Add(-time.Minute))
+	tokens := newTestTokenManager(f, expired, nil)
+
+	if got := tokens.token(context.Background()); got != expired {
+		t.Errorf("token() = %q, want the old token", got)
+	}
+	if got := tokens.authState(); got != "refresh_failed" {
+		t.Errorf("authState() = %q, want refresh_failed", got)
+	}
+}
+
+func TestTokenRefreshBacksOffAfterFailure(t *testing.T) {
+	f := newFakeAuthServer(t, "")
+	f.status = http.StatusUnauthorized
+
+	reloads := 0
+	expired := fakeJWT(authTestNow.Add(-time.Minute))
+	tokens := newTestTokenManager(f, expired, func() (*cursorCredentials, error) {
+		reloads++
+		return nil, errors.New("no state database")
+	})
+
+	now := authTestNow
+	tokens.now = func() time.Time { return now }
+
+	for range 3 {
+		tokens.token(context.Background())
+	}
+	if err := tokens.invalidate(context.Background(), expired); err == nil {
+		t.Error("invalidate() during the backoff succeeded, want the last error")
+	}
+	if hits := f.hits.Load(); hits != 1 || reloads != 1 {
+		t.Errorf("during the backoff: %d exchanges and %d reloads, want 1 of each", hits, reloads)
+	}
+
+	now = now.Add(tokenRefreshBackoff)
+	f.status = http.StatusOK
+	f.issued = fakeJWT(now.Add(time.Hour))
+
+	if got := tokens.token(context.Background()); got != f.issued {
+		t.Errorf("token() after the backoff = %q, want %q", got, f.issued)
+	}
+	if hits := f.hits.Load(); hits != 2 {
+		t.Errorf("token endpoint hit %d times, want 2", hits)
+	}
+	if got := tokens.authState(); got != "ok" {
+		t.Errorf("authState() = %q, want ok", got)
+	}
+}
+
+func TestTokenRefreshDoesNotBlockAuthState(t *testing.T) {
+	f := newFakeAuthServer(t, fakeJWT(authTestNow.Add(time.Hour)))
+	f.release = make(chan struct{})
+
+	tokens := newTestTokenManager(f, fakeJWT(authTestNow.Add(-time.Minute)), nil)
+
+	results := make(chan string, 2)
+	for range 2 {
+		go func() { results <- tokens.token(context.Background()) }()
+	}
+
+	for f.hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	state := make(chan string)
+	go func() { state <- tokens.authState() }()
+
+	select {
+	case got := <-state:
+		if got != "expired" {
+			t.Errorf("authState() = %q, want expired", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("authState() blocked on the refresh in flight")
+	}
+
+	close(f.release)
+
+	for range 2 {
+		if got := <-results; got != f.issued {
+			t.Errorf("token() = %q, want %q", got, f.issued)
+		}
+	}
+	if hits := f.hits.Load(); hits != 1 {
+		t.Errorf("token endpoint hit %d times, want 1", hits)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	current := fakeJWT(authTestNow.Add(time.Hour))
+
+	t.Run("rejected token is refreshed", func(t *testing.T) {
+		f := newFakeAuthServer(t, "new")
+		tokens := newTestTokenManager(f, current, nil)
+
+		if err := tokens.invalidate(context.Background(), current); err != nil {
+			t.Fatalf("invalidate() error = %v", err)
+		}
+		if got := tokens.token(context.Background()); got != "new" {
+			t.Errorf("token() = %q, want new", got)
+		}
+	})
+
+	t.Run("already replaced", func(t *testing.T) {
+		f := newFakeAuthServer(t, "new")
+		tokens := newTestTokenManager(f, current, nil)
+
+		if err := tokens.invalidate(context.Background(), "older"); err != nil {
+			t.Fatalf("invalidate() error = %v", err)
+		}
+		if hits := f.hits.Load(); hits != 0 {
+			t.Errorf("token endpoint hit %d times, want 0", hits)
+		}
+	})
+
+	t.Run("falls back to the state database", func(t *testing.T) {
+		f := newFakeAuthServer(t, "")
+		f.status = http.StatusBadRequest
+
+		tokens := newTestTokenManager(f, current, func() (*cursorCredentials, error) {
+			return &cursorCredentials{accessToken: "reloaded", refreshToken: "refresh2"}, nil
+		})
+
+		if err := tokens.invalidate(context.Background(), current); err != nil {
+			t.Fatalf("invalidate() error = %v", err)
+		}
+		if got := tokens.token(context.Background()); got != "reloaded" {
+			t.Errorf("token() = %q, want reloaded", got)
+		}
+		if tokens.refreshToken != "refresh2" {
+			t.Errorf("refreshToken = %q, want refresh2", tokens.refreshToken)
+		}
+	})
+
+	t.Run("state database has the same token", func(t *testing.T) {
+		f := newFakeAuthServer(t, "")
+		f.status = http.StatusBadRequest
+
+		tokens := newTestTokenManager(f, current, func() (*cursorCredentials, error) {
+			return &cursorCredentials{accessToken: current}, nil
+		})
+
+		if err := tokens.invalidate(context.Background(), current); err == nil {
+			t.Fatal("invalidate() succeeded, want an error")
+		}
+		if got := tokens.authState(); got != "refresh_failed" {
+			t.Errorf("authState() = %q, want refresh_failed", got)
+		}
+	})
+}
+
+func TestOpenStreamRetriesUnauthenticated(t *testing.T) {
+	tests := []struct {
+		name      string
+		accepted  string
+		wantCode  connect.Code
+		wantCalls int32
+		wantHits  int32
+	}{
+		{name: "valid token", accepted: "old", wantCalls: 1},
+		{name: "refreshed once", accepted: "new", wantCalls: 2, wantHits: 1},
+		{name: "still rejected", accepted: "none", wantCode: connect.CodeUnauthenticated, wantCalls: 2, wantHits: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeAuthServer(t, "new")
+			tokens := newTestTokenManager(f, "old", nil)
+
+			var calls atomic.Int32
+			mux := http.NewServeMux()
+			mux.Handle("/test.Service/Stream", connect.NewServerStreamHandler("/test.Service/Stream",
+				func(_ context.Context, req *connect.Request[wrapperspb.StringValue], stream *connect.ServerStream[wrapperspb.StringValue]) error {
+					calls.Add(1)
+					if req.Header().Get("authorization") != "bearer "+tt.accepted {
+						return connect.NewError(connect.CodeUnauthenticated, errors.New("bad token"))
+					}
+					return stream.Send(wrapperspb.String("hello " + req.Msg.Value))
+				}))
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			client := connect.NewClient[wrapperspb.StringValue, wrapperspb.StringValue](server.Client(), server.URL+"/test.Service/Stream")
+
+			stream, ok, err := openStream(context.Background(), tokens, client.CallServerStream, func(accessToken string) *connect.Request[wrapperspb.StringValue] {
+				req := connect.NewRequest(wrapperspb.String("world"))
+				req.Header().Set("authorization", "bearer "+accessToken)
+				return req
+			})
+
+			if tt.wantCode != 0 {
+				if connect.CodeOf(err) != tt.wantCode {
+					t.Fatalf("openStream() error = %v, want %v", err, tt.wantCode)
+				}
+			} else {
+				if err != nil || !ok {
+					t.Fatalf("openStream() = %v, %v", ok, err)
+				}
+				if got := stream.Msg().Value; got != "hello world" {
+					t.Errorf("first message = %q", got)
+				}
+				stream.Close()
+			}
+
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("stream opened %d times, want %d", got, tt.wantCalls)
+			}
+			if got := f.hits.Load(); got != tt.wantHits {
+				t.Errorf("token endpoint hit %d times, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
@@ -8,198 +8,196 @@ import (
 )
 
 type buffer struct {
-	lines       []string
-	row         int
-	col         int
-	path        string
-	version     int
-	id          nvim.Buffer
-	diffHistory []string
+	// lines, row, col, path, version and tick are guarded by the state's
+	// applyBatchMu. Code that runs without it works on a snapshot.
+	lines   []string
+	row     int
+	col     int
+	path    string
+	version int
+	id      nvim.Buffer
+
+	// tick is the changedtick lines were read at.
+	tick int
+
+	// model and attached are guarded by the registry lock.
+	model    lineModel
+	attached bool
+
+	// pending is the previewed suggestion waiting for tab. streaming is the
+	// id of the suggestion still arriving, 0 if none, and acceptOnDone is
+	// set when tab was pressed before it finished. All of them are guarded
+	// by the state's applyBatchMu.
+	pending      *suggestion
+	streams      uint64
+	streaming    uint64
+	acceptOnDone bool
 }
 
-func newBuffer() (*buffer, error) {
-	log.Printf("creating new buffer")
+func newBuffer(id nvim.Buffer) *buffer {
+	log.Printf("creating new buffer %d", id)
 
 	return &buffer{
-		lines:       []string{},
-		row:         0,
-		col:         0,
-		path:        "",
-		version:     0,
-		id:          nvim.Buffer(0),
-		diffHistory: []string{},
-	}, nil
+		lines:   []string{},
+		row:     0,
+		col:     0,
+		path:    "",
+		version: 0,
+		id:      id,
+	}
 }
 
-func (b *buffer) syncIn(v *nvim.Nvim) {
-	currentBuf, err := v.CurrentBuffer()
-	if err != nil {
-		log.Printf("error getting current buffer: %v", err)
-		return
-	}
+// bufferSync is what syncIn read from Neovim, waiting to be stored.
+type bufferSync struct {
+	lines []string
+	tick  int
+	row   int
+	col   int
+	path  string
+}
 
-	path, err := v.BufferName(currentBuf)
+// syncIn reads b's lines, path and cursor from Neovim. It doesn't touch b,
+// so it can run without holding applyBatchMu.
+func (b *buffer) syncIn(v *nvim.Nvim, r *bufferRegistry) (bufferSync, error) {
+	path, err := v.BufferName(b.id)
 	if err != nil {
-		log.Printf("error getting buffer name: %v", err)
-		return
+		return bufferSync{}, fmt.Errorf("error getting buffer name: %w", err)
 	}
 
-	lines, err := v.BufferLines(currentBuf, 0, -1, false)
+	lines, tick, err := r.lines(v, b)
 	if err != nil {
-		log.Printf("error getting buffer lines: %v", err)
-		return
-	}
-
-	linesStr := make([]string, len(lines))
-	for i, line := range lines {
-		linesStr[i] = string(line[:])
+		return bufferSync{}, fmt.Errorf("error getting buffer lines: %w", err)
 	}
 
 	window, err := v.CurrentWindow()
 	if err != nil {
-		log.Printf("error getting current window: %v", err)
-		return
+		return bufferSync{}, fmt.Errorf("error getting current window: %w", err)
 	}
 
 	cursor, err := v.WindowCursor(window)
 	if err != nil {
-		log.Printf("error getting window cursor: %v", err)
-		return
+		return bufferSync{}, fmt.Errorf("error getting window cursor: %w", err)
 	}
 
-	b.lines = linesStr
-	b.row = cursor[1]
-	b.col = cursor[0] - 1
+	return bufferSync{
+		lines: lines,
+		tick:  tick,
+		row:   cursor[1],
+		col:   cursor[0] - 1,
+		path:  path,
+	}, nil
+}
+
+// store replaces what b last synced. The caller holds applyBatchMu.
+func (b *buffer) store(synced bufferSync) {
+	b.lines = synced.lines
+	b.tick = synced.tick
+	b.row = synced.row
+	b.col = synced.col
+	b.path = synced.path
 
 	log.Printf("synced col: %v, row: %v", b.col, b.row)
+}
 
-	b.path = path
-	if b.id != currentBuf {
-		b.id = currentBuf
-		b.diffHistory = []string{}
-		b.version = 0
+// snapshot copies what b last synced, for use after applyBatchMu is
+// released. The caller holds applyBatchMu.
+func (b *buffer) snapshot() *buffer {
+	return &buffer{
+		lines:   b.lines,
+		row:     b.row,
+		col:     b.col,
+		path:    b.path,
+		version: b.version,
+		id:      b.id,
+		tick:    b.tick,
 	}
 }
 
-func (b *buffer) editLines(v *nvim.Nvim, applyBatch *nvim.Batch, nsID, startLine, endLineInclusive int, place []string) *nvim.Batch {
-	batch := v.NewBatch()
-
+// applyLua makes a textEdit if the buffer's changedtick is still the one
+// the suggestion was made against, and returns the new changedtick, or -1
+// if the buffer has changed. Resetting undolevels starts a new undo block,
+// so the edit undoes in one step even in insert mode, and the view is put
+// back after moving the cursor so accepting doesn't scroll.
+const applyLua = `
+local buf, tick, start_row, start_col, end_row, end_col, lines, cursor_row, cursor_col = ...
+if vim.api.nvim_buf_get_changedtick(buf) ~= tick then
+	return -1
+end
+vim.api.nvim_buf_call(buf, function()
+	vim.go.undolevels = vim.go.undolevels
+end)
+vim.api.nvim_buf_set_text(buf, start_row, start_col, end_row, end_col, lines)
+if vim.api.nvim_get_current_buf() == buf then
+	local view = vim.fn.winsaveview()
+	vim.api.nvim_win_set_cursor(0, { cursor_row + 1, cursor_col })
+	vim.fn.winrestview({ topline = view.topline, leftcol = view.leftcol })
+end
+return vim.api.nvim_buf_get_changedtick(buf)
+`
+
+// apply queues sg's edit on batch along with clearing its preview. Once the
+// batch has run tick holds the buffer's new changedtick, or -1 if the buffer
+// changed since sg was made and nothing was applied; only in the first case
+// should the caller bump the version. lines are b's lines as of sg.tick.
+func (b *buffer) apply(batch *nvim.Batch, nsID int, sg *suggestion, lines []string, tick *int) {
 	b.clearNamespace(batch, nsID)
 
-	log.Printf("editing lines %d..%d in buffer %d", startLine, endLineInclusive, b.id)
-
-	log.Printf("applied line modification: %v", nsID)
+	edit := sg.textEdit(lines)
 
-	dummyIdRxPtr := 0
-	diffStr := ""
-	lastModifiedLine := 0
-
-	for i := startLine; i <= endLineInclusive; i++ {
-		relativeLineIdx := i - startLine
+	log.Printf("applying to buffer %d (%d:%d..%d:%d)", b.id, edit.startRow, edit.startCol, edit.endRow, edit.endCol)
 
-		var l *string
-		var realL *string
+	batch.ExecLua(applyLua, tick, b.id, sg.tick, edit.startRow, edit.startCol, edit.endRow, edit.endCol, edit.lines, edit.cursorRow, edit.cursorCol)
+}
 
-		if i < len(b.lines) {
-			realL = &b.lines[i]
-		}
+// preview shows sg over the buffer: changed lines are highlighted with
+// their new text at the end, removed lines are highlighted and added lines
+// appear as virtual lines. The old preview is cleared in the same batch, so
+// redrawing it as a suggestion streams in doesn't flicker.
+func (b *buffer) preview(v *nvim.Nvim, nsID int, sg *suggestion) error {
+	batch := v.NewBatch()
 
-		log.Printf("relativeLineIdx: %d", relativeLineIdx)
+	b.clearNamespace(batch, nsID)
 
-		if relativeLineIdx < len(place) {
-			log.Printf("placing line %d", relativeLineIdx)
-			l = &place[relativeLineIdx]
-		}
+	log.Printf("previewing lines %d..%d in buffer %d", sg.start, sg.start+len(sg.old), b.id)
 
-		if l != nil && realL != nil && *l == *realL {
-			log.Printf("lines identical so skipping preview")
-			continue
-		}
+	dummyIdRxPtr := 0
 
-		lastModifiedLine = i
-
-		if l != nil && realL != nil && *l != *realL {
-			log.Printf("lines different so adding preview")
-			diffStr += fmt.Sprintf("%d-|%s\n", i+1, *realL)
-			diffStr += fmt.Sprintf("%d+|%s\n", i+1, *l)
-		} else if l != nil && realL == nil {
-			log.Printf("adding new line to preview")
-			diffStr += fmt.Sprintf("%d+|%s\n", i+1, *l)
-		} else if l == nil && realL != nil {
-			log.Printf("removing line from preview")
-			diffStr += fmt.Sprintf("%d-|%s\n", i+1, *realL)
-		}
+	for i := range sg.old {
+		line := sg.start + i
 
-		if l != nil && realL != nil {
-			log.Printf("adding buffer extmark + hl to line %d", i)
-			batch.SetBufferExtmark(b.id, nsID, i, 0, map[string]any{
-				"virt_text":     []any{[]any{*l, "cursortabhl_addition"}},
+		if i < len(sg.lines) {
+			batch.SetBufferExtmark(b.id, nsID, line, 0, map[string]any{
+				"virt_text":     []any{[]any{sg.lines[i], "cursortabhl_addition"}},
 				"virt_text_pos": "eol",
 				"hl_mode":       "combine",
 			}, &dummyIdRxPtr)
-
-			batch.AddBufferHighlight(b.id, nsID, "cursortabhl", i, 0, -1, &dummyIdRxPtr)
-
-			log.Printf("added buffer extmark + hl to line %d", i)
-		} else {
-			log.Printf("nothing to preview")
 		}
-	}
 
-	if len(place) >= startLine-lastModifiedLine {
-		lastModifiedLine = startLine + len(place) - 1
+		batch.AddBufferHighlight(b.id, nsID, "cursortabhl", line, 0, -1, &dummyIdRxPtr)
 	}
 
-	log.Printf("diffStr: %s", diffStr)
-
-	b.diffHistory = append(b.diffHistory, diffStr)
-	if len(b.diffHistory) > 3 {
-		b.diffHistory = b.diffHistory[len(b.diffHistory)-3:]
-	}
-
-	if err := batch.Execute(); err != nil {
-		log.Printf("error executing hl batch: %v", err)
-		return nil
-	}
-
-	if applyBatch == nil {
-		applyBatch = v.NewBatch()
-	}
+	if len(sg.lines) > len(sg.old) {
+		var virtLines []any
+		for _, line := range sg.lines[len(sg.old):] {
+			virtLines = append(virtLines, []any{[]any{line, "cursortabhl_addition"}})
+		}
 
-	b.clearNamespace(applyBatch, nsID)
+		opts := map[string]any{"virt_lines": virtLines}
 
-	log.Printf("applying to buffer %d (%d..%d)", b.id, startLine, endLineInclusive)
+		anchor := sg.start + len(sg.old) - 1
+		if anchor < 0 {
+			anchor = 0
+			opts["virt_lines_above"] = true
+		}
 
-	placeBytes := make([][]byte, len(place))
-	for i, line := range place {
-		placeBytes[i] = []byte(line)
+		batch.SetBufferExtmark(b.id, nsID, anchor, 0, opts, &dummyIdRxPtr)
 	}
 
-	// execute lua to actually clear the lines within the range beforehand
-	applyBatch.ExecLua(fmt.Sprintf("vim.cmd('normal! %v,%vd')", startLine+1, endLineInclusive+1), nil, nil)
-
-	applyBatch.SetBufferLines(b.id, startLine, endLineInclusive, false, placeBytes)
-
-	if lastModifiedLine > 0 {
-		applyBatch.SetWindowCursor(0, [2]int{lastModifiedLine + 1, 0})
-		applyBatch.ExecLua("vim.cmd('normal! zz')", nil, nil)
-		applyBatch.ExecLua("vim.cmd('normal! 1000l')", nil, nil)
+	if sg.jump >= 0 {
+		batch.AddBufferHighlight(b.id, nsID, "cursortabhl_yellowish", sg.jump, 0, -1, &dummyIdRxPtr)
 	}
 
-	b.version++
-
-	return applyBatch
-}
-
-func (b *buffer) setCursorPosition(v *nvim.Nvim, nsID, col int) *nvim.Batch {
-	applyBatch := v.NewBatch()
-	applyBatch.SetWindowCursor(0, [2]int{col, 0})
-
-	dummyIdRxPtr := 0
-
-	applyBatch.AddBufferHighlight(b.id, nsID, "cursortabhl_yellowish", col, 0, -1, &dummyIdRxPtr)
-
-	return applyBatch
+	return batch.Execute()
 }
 
 func (b *buffer) clearNamespace(batch *nvim.Batch, nsID int) {
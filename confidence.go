@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// suggestionShownLua stores the confidence of the previewed suggestion in
+// b:cursortab_confidence and fires User CursorTabSuggestion, so it can be
+// shown in the statusline or alongside the preview.
+const suggestionShownLua = `
+local bufnr, confidence = ...
+vim.b[bufnr].cursortab_confidence = confidence
+vim.api.nvim_exec_autocmds("User", {
+	pattern = "CursorTabSuggestion",
+	modeline = false,
+	data = { buf = bufnr, confidence = confidence },
+})
+`
+
+// suggestionClearedLua drops b:cursortab_confidence once the preview is
+// gone, whether it was accepted or discarded.
+const suggestionClearedLua = `
+local bufnr = ...
+if vim.api.nvim_buf_is_valid(bufnr) then
+	vim.b[bufnr].cursortab_confidence = nil
+end
+`
+
+// lowConfidence reports whether a suggestion with confidence should be
+// dropped given minimum. Suggestions the server didn't score are kept.
+func lowConfidence(confidence *int32, minimum int) bool {
+	return minimum > 0 && confidence != nil && int(*confidence) < minimum
+}
+
+func (s *state) suggestionShown(b *buffer, confidence *int32) {
+	var value any
+	if confidence != nil {
+		value = *confidence
+	}
+
+	if err := s.v.ExecLua(suggestionShownLua, nil, b.id, value); err != nil {
+		log.Printf("error publishing suggestion confidence: %v", err)
+	}
+}
+
+func (b *buffer) clearSuggestion(batch *nvim.Batch) {
+	batch.ExecLua(suggestionClearedLua, nil, b.id)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is read from $XDG_CONFIG_HOME/cursortab/config.json, with
+// CURSORTAB_* environment variables taking precedence over the file.
+type config struct {
+	BaseURL         string            `json:"base_url"`
+	AuthURL         string            `json:"auth_url"`
+	ClientVersion   string            `json:"client_version"`
+	Headers         map[string]string `json:"headers"`
+	RequestTimeout  duration          `json:"request_timeout"`
+	CppTimeout      duration          `json:"cpp_request_timeout"`
+	Debounce        duration          `json:"debounce"`
+	MaxOpenFiles    int               `json:"max_open_files"`
+	MaxOpenBytes    int               `json:"max_open_bytes"`
+	LspBudget       duration          `json:"lsp_budget"`
+	WindowThreshold int               `json:"window_threshold"`
+	Filesync        bool              `json:"filesync"`
+	MinConfidence   int               `json:"min_confidence"`
+	LogFile         string            `json:"log_file"`
+	StateDB         string            `json:"state_db"`
+}
+
+// duration accepts Go duration strings ("1500ms") in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+func defaultConfig() *config {
+	return &config{
+		BaseURL:         "https://api2.cursor.sh",
+		AuthURL:         "https://prod.authentication.cursor.sh/oauth/token",
+		ClientVersion:   "0.45.0",
+		Headers:         map[string]string{},
+		RequestTimeout:  duration(10 * time.Second),
+		CppTimeout:      duration(5 * time.Second),
+		MaxOpenFiles:    10,
+		MaxOpenBytes:    64 * 1024,
+		LspBudget:       duration(150 * time.Millisecond),
+		WindowThreshold: 2000,
+		LogFile:         "cursortablogs",
+	}
+}
+
+// reservedHeaders are set per request and can't be overridden from config.
+var reservedHeaders = []string{"authorization", "x-cursor-checksum", "x-cursor-client-version"}
+
+// configPath returns where the config file is expected, honoring
+// CURSORTAB_CONFIG for an explicit location.
+func configPath() string {
+	if path := os.Getenv("CURSORTAB_CONFIG"); path != "" {
+		return path
+	}
+
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = os.Getenv("HOME")
+		}
+		dir = filepath.Join(home, ".config")
+	}
+
+	return filepath.Join(dir, "cursortab", "config.json")
+}
+
+// loadConfig reads and validates the config. A setting that doesn't
+// parse or validate is left at its default and reported in the returned
+// error, while the rest still apply, so the caller can keep running and
+// tell the user.
+func loadConfig() (*config, error) {
+	cfg := defaultConfig()
+	path := configPath()
+
+	var errs []error
+
+	raw, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := cfg.applyFile(raw); err != nil {
+			errs = append(errs, fmt.Errorf("error parsing %s: %w", path, err))
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		errs = append(errs, fmt.Errorf("error reading %s: %w", path, err))
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid config: %w", err))
+	}
+
+	return cfg, errors.Join(errs...)
+}
+
+// applyFile sets the keys of the JSON object raw one at a time, so a key
+// that is unknown or doesn't parse leaves only its own setting alone.
+func (c *config) applyFile(raw []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		one, err := json.Marshal(map[string]json.RawMessage{key: fields[key]})
+		if err != nil {
+			return err
+		}
+
+		next := *c
+		next.Headers = maps.Clone(c.Headers)
+
+		d := json.NewDecoder(bytes.NewReader(one))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&next); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+
+		*c = next
+	}
+
+	return errors.Join(errs...)
+}
+
+// applyEnv applies the CURSORTAB_* variables. One that doesn't parse is
+// reported and leaves its setting as it was.
+func (c *config) applyEnv() error {
+	var errs []error
+
+	if v := os.Getenv("CURSORTAB_BASE_URL"); v != "" {
+		c.BaseURL = v
+	}
+
+	if v := os.Getenv("CURSORTAB_AUTH_URL"); v != "" {
+		c.AuthURL = v
+	}
+
+	if v := os.Getenv("CURSORTAB_CLIENT_VERSION"); v != "" {
+		c.ClientVersion = v
+	}
+
+	if v := os.Getenv("CURSORTAB_LOG_FILE"); v != "" {
+		c.LogFile = v
+	}
+
+	if v := os.Getenv(stateDBOverrideEnv); v != "" {
+		c.StateDB = v
+	}
+
+	if v := os.Getenv("CURSORTAB_REQUEST_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CURSORTAB_REQUEST_TIMEOUT: %w", err))
+		} else {
+			c.RequestTimeout = duration(timeout)
+		}
+	}
+
+	if v := os.Getenv("CURSORTAB_DEBOUNCE"); v != "" {
+		debounce, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CURSORTAB_DEBOUNCE: %w", err))
+		} else {
+			c.Debounce = duration(debounce)
+		}
+	}
+
+	if v := os.Getenv("CURSORTAB_CPP_REQUEST_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CURSORTAB_CPP_REQUEST_TIMEOUT: %w", err))
+		} else {
+			c.CppTimeout = duration(timeout)
+		}
+	}
+
+	if v := os.Getenv("CURSORTAB_LSP_BUDGET"); v != "" {
+		budget, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CURSORTAB_LSP_BUDGET: %w", err))
+		} else {
+			c.LspBudget = duration(budget)
+		}
+	}
+
+	if v := os.Getenv("CURSORTAB_MAX_OPEN_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CURSORTAB_MAX_OPEN_FILES: %w", err))
+		} else {
+			c.MaxOpenFiles = n
+		}
+	}
+
+	if v := os.Getenv("CURSORTAB_MAX_OPEN_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CURSORTAB_MAX_OPEN_BYTES: %w", err))
+		} else {
+			c.MaxOpenBytes = n
+		}
+	}
+
+	if v := os.Getenv("CURSORTAB_WINDOW_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CURSORTAB_WINDOW_THRESHOLD: %w", err))
+		} else {
+			c.WindowThreshold = n
+		}
+	}
+
+	if v := os.Getenv("CURSORTAB_FILESYNC"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CURSORTAB_FILESYNC: %w", err))
+		} else {
+			c.Filesync = enabled
+		}
+	}
+
+	if v := os.Getenv("CURSORTAB_MIN_CONFIDENCE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CURSORTAB_MIN_CONFIDENCE: %w", err))
+		} else {
+			c.MinConfidence = n
+		}
+	}
+
+	// CURSORTAB_HEADERS is a comma separated list of name=value pairs.
+	if v := os.Getenv("CURSORTAB_HEADERS"); v != "" {
+		if c.Headers == nil {
+			c.Headers = map[string]string{}
+		}
+
+		for _, pair := range strings.Split(v, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				errs = append(errs, fmt.Errorf("invalid CURSORTAB_HEADERS entry %q, expected name=value", pair))
+				continue
+			}
+			c.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks every setting, putting the invalid ones back to their
+// defaults and dropping invalid headers. The returned error lists them all.
+func (c *config) validate() error {
+	def := defaultConfig()
+	var errs []error
+
+	if err := validateURL(c.BaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("base_url: %w", err))
+		c.BaseURL = def.BaseURL
+	}
+	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+
+	if err := validateURL(c.AuthURL); err != nil {
+		errs = append(errs, fmt.Errorf("auth_url: %w", err))
+		c.AuthURL = def.AuthURL
+	}
+
+	if strings.TrimSpace(c.ClientVersion) == "" {
+		errs = append(errs, errors.New("client_version: must not be empty"))
+		c.ClientVersion = def.ClientVersion
+	}
+
+	if c.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("request_timeout: must be positive"))
+		c.RequestTimeout = def.RequestTimeout
+	}
+
+	if c.CppTimeout <= 0 {
+		errs = append(errs, errors.New("cpp_request_timeout: must be positive"))
+		c.CppTimeout = def.CppTimeout
+	}
+
+	if c.Debounce < 0 {
+		errs = append(errs, errors.New("debounce: must not be negative"))
+		c.Debounce = def.Debounce
+	}
+
+	if c.LspBudget < 0 {
+		errs = append(errs, errors.New("lsp_budget: must not be negative"))
+		c.LspBudget = def.LspBudget
+	}
+
+	if c.MaxOpenFiles < 0 {
+		errs = append(errs, errors.New("max_open_files: must not be negative"))
+		c.MaxOpenFiles = def.MaxOpenFiles
+	}
+
+	if c.MaxOpenBytes < 0 {
+		errs = append(errs, errors.New("max_open_bytes: must not be negative"))
+		c.MaxOpenBytes = def.MaxOpenBytes
+	}
+
+	if c.WindowThreshold < 0 {
+		errs = append(errs, errors.New("window_threshold: must not be negative"))
+		c.WindowThreshold = def.WindowThreshold
+	}
+
+	if c.MinConfidence < 0 {
+		errs = append(errs, errors.New("min_confidence: must not be negative"))
+		c.MinConfidence = def.MinConfidence
+	}
+
+	if c.LogFile == "" {
+		errs = append(errs, errors.New("log_file: must not be empty"))
+		c.LogFile = def.LogFile
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Headers)) {
+		if err := validateHeader(name, c.Headers[name]); err != nil {
+			errs = append(errs, fmt.Errorf("headers: %w", err))
+			delete(c.Headers, name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateHeader checks a configured header can be sent as is.
+func validateHeader(name, value string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid value for %q", name)
+	}
+	for _, reserved := range reservedHeaders {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("%q is set by cursortab and can't be overridden", name)
+		}
+	}
+
+	return nil
+}
+
+// validateURL checks raw is an absolute http or https URL.
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+
+	return nil
+}
+
+func (c *config) timeout() time.Duration {
+	return time.Duration(c.RequestTimeout)
+}
+
+func (c *config) cppTimeout() time.Duration {
+	return time.Duration(c.CppTimeout)
+}
+
+func (c *config) setHeaders(h http.Header) {
+	for name, value := range c.Headers {
+		h.Set(name, value)
+	}
+	h.Set("x-cursor-client-version", c.ClientVersion)
+}
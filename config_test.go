@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configEnv is every variable applyEnv reads.
+var configEnv = []string{
+	"CURSORTAB_BASE_URL", "CURSORTAB_AUTH_URL", "CURSORTAB_CLIENT_VERSION", "CURSORTAB_LOG_FILE", stateDBOverrideEnv,
+	"CURSORTAB_REQUEST_TIMEOUT", "CURSORTAB_DEBOUNCE", "CURSORTAB_CPP_REQUEST_TIMEOUT", "CURSORTAB_LSP_BUDGET",
+	"CURSORTAB_MAX_OPEN_FILES", "CURSORTAB_MAX_OPEN_BYTES", "CURSORTAB_WINDOW_THRESHOLD", "CURSORTAB_FILESYNC",
+	"CURSORTAB_MIN_CONFIDENCE", "CURSORTAB_HEADERS",
+}
+
+func setConfigEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	for _, name := range configEnv {
+		t.Setenv(name, env[name])
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		check   func(*config) bool
+		wantErr []string
+	}{
+		{
+			name: "strings",
+			env:  map[string]string{"CURSORTAB_BASE_URL": "https://proxy", "CURSORTAB_AUTH_URL": "https://auth/token", stateDBOverrideEnv: "/db", "CURSORTAB_LOG_FILE": "/log"},
+			check: func(c *config) bool {
+				return c.BaseURL == "https://proxy" && c.AuthURL == "https://auth/token" && c.StateDB == "/db" && c.LogFile == "/log"
+			},
+		},
+		{
+			name: "numbers and durations",
+			env:  map[string]string{"CURSORTAB_DEBOUNCE": "75ms", "CURSORTAB_MAX_OPEN_FILES": "3", "CURSORTAB_FILESYNC": "true", "CURSORTAB_MIN_CONFIDENCE": "2"},
+			check: func(c *config) bool {
+				return c.Debounce == duration(75*time.Millisecond) && c.MaxOpenFiles == 3 && c.Filesync && c.MinConfidence == 2
+			},
+		},
+		{
+			name: "headers",
+			env:  map[string]string{"CURSORTAB_HEADERS": "x-a = 1, x-b=2"},
+			check: func(c *config) bool {
+				return c.Headers["x-a"] == "1" && c.Headers["x-b"] == "2"
+			},
+		},
+		{
+			name: "a bad variable keeps the rest",
+			env:  map[string]string{"CURSORTAB_DEBOUNCE": "soon", stateDBOverrideEnv: "/db", "CURSORTAB_MAX_OPEN_FILES": "7"},
+			check: func(c *config) bool {
+				return c.Debounce == 0 && c.StateDB == "/db" && c.MaxOpenFiles == 7
+			},
+			wantErr: []string{"CURSORTAB_DEBOUNCE"},
+		},
+		{
+			name: "every bad variable is reported",
+			env:  map[string]string{"CURSORTAB_REQUEST_TIMEOUT": "x", "CURSORTAB_FILESYNC": "maybe", "CURSORTAB_HEADERS": "x-a=1,broken"},
+			check: func(c *config) bool {
+				return c.RequestTimeout == defaultConfig().RequestTimeout && !c.Filesync && c.Headers["x-a"] == "1"
+			},
+			wantErr: []string{"CURSORTAB_REQUEST_TIMEOUT", "CURSORTAB_FILESYNC", `"broken"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfigEnv(t, tt.env)
+
+			cfg := defaultConfig()
+			err := cfg.applyEnv()
+
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatalf("applyEnv() error = %v", err)
+			}
+			for _, want := range tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("applyEnv() error = %v, want it to mention %s", err, want)
+				}
+			}
+			if !tt.check(cfg) {
+				t.Errorf("applyEnv() gave %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*config)
+		check   func(*config) bool
+		wantErr string
+	}{
+		{
+			name:   "defaults",
+			change: func(*config) {},
+			check:  func(*config) bool { return true },
+		},
+		{
+			name:   "trailing slash",
+			change: func(c *config) { c.BaseURL = "https://proxy/" },
+			check:  func(c *config) bool { return c.BaseURL == "https://proxy" },
+		},
+		{
+			name:    "bad base_url",
+			change:  func(c *config) { c.BaseURL = "ftp://x"; c.StateDB = "/db" },
+			check:   func(c *config) bool { return c.BaseURL == defaultConfig().BaseURL && c.StateDB == "/db" },
+			wantErr: "base_url",
+		},
+		{
+			name:    "auth_url without host",
+			change:  func(c *config) { c.AuthURL = "https://" },
+			check:   func(c *config) bool { return c.AuthURL == defaultConfig().AuthURL },
+			wantErr: "auth_url",
+		},
+		{
+			name:    "negative debounce",
+			change:  func(c *config) { c.Debounce = -1; c.MaxOpenFiles = 3 },
+			check:   func(c *config) bool { return c.Debounce == 0 && c.MaxOpenFiles == 3 },
+			wantErr: "debounce",
+		},
+		{
+			name:    "zero timeout",
+			change:  func(c *config) { c.CppTimeout = 0 },
+			check:   func(c *config) bool { return c.CppTimeout == defaultConfig().CppTimeout },
+			wantErr: "cpp_request_timeout",
+		},
+		{
+			name:    "empty log_file",
+			change:  func(c *config) { c.LogFile = "" },
+			check:   func(c *config) bool { return c.LogFile == defaultConfig().LogFile },
+			wantErr: "log_file",
+		},
+		{
+			name:    "reserved header",
+			change:  func(c *config) { c.Headers = map[string]string{"Authorization": "x", "x-ok": "1"} },
+			check:   func(c *config) bool { return len(c.Headers) == 1 && c.Headers["x-ok"] == "1" },
+			wantErr: "Authorization",
+		},
+		{
+			name:    "header value with a newline",
+			change:  func(c *config) { c.Headers = map[string]string{"x-a": "1\r\nx-b: 2"} },
+			check:   func(c *config) bool { return len(c.Headers) == 0 },
+			wantErr: "x-a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.change(cfg)
+
+			err := cfg.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("validate() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() error = %v, want it to mention %s", err, tt.wantErr)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("validate() left %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigKeepsGoodSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	raw := `{
+		"log_file": "/var/log/cursortab",
+		"debounce": 75,
+		"max_open_files": 3,
+		"lsp_budjet": "1s",
+		"min_confidence": -1
+	}`
+	if err := os.WriteFile(path, []byte(raw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	setConfigEnv(t, map[string]string{stateDBOverrideEnv: "/db", "CURSORTAB_CPP_REQUEST_TIMEOUT": "later"})
+	t.Setenv("CURSORTAB_CONFIG", path)
+
+	cfg, err := loadConfig()
+
+	for _, want := range []string{"debounce", `"lsp_budjet"`, "min_confidence", "CURSORTAB_CPP_REQUEST_TIMEOUT"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loadConfig() error = %v, want it to mention %s", err, want)
+		}
+	}
+
+	def := defaultConfig()
+	if cfg.LogFile != "/var/log/cursortab" || cfg.MaxOpenFiles != 3 || cfg.StateDB != "/db" {
+		t.Errorf("good settings lost: %+v", cfg)
+	}
+	if cfg.Debounce != def.Debounce || cfg.LspBudget != def.LspBudget || cfg.MinConfidence != def.MinConfidence || cfg.CppTimeout != def.CppTimeout {
+		t.Errorf("bad settings not left at their defaults: %+v", cfg)
+	}
+}
+
+func TestLoadConfigUnreadable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`["not", "an", "object"]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	setConfigEnv(t, map[string]string{stateDBOverrideEnv: "/db"})
+	t.Setenv("CURSORTAB_CONFIG", path)
+
+	cfg, err := loadConfig()
+	if err == nil {
+		t.Fatal("loadConfig() succeeded, want an error")
+	}
+	if cfg.StateDB != "/db" || cfg.LogFile != defaultConfig().LogFile {
+		t.Errorf("loadConfig() = %+v, want defaults with the environment applied", cfg)
+	}
+}
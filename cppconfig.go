@@ -0,0 +1,159 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cppConfigRefreshInterval is how often the server-side tab config is
+	// refetched while the plugin is running.
+	cppConfigRefreshInterval = 30 * time.Minute
+
+	// lotsOfAddedTextLines is how many net new lines a suggestion may add
+	// before HEURISTIC_LOTS_OF_ADDED_TEXT rejects it.
+	lotsOfAddedTextLines = 25
+)
+
+// cppSettings are the server-driven knobs for tab completions, resolved
+// against our defaults.
+type cppSettings struct {
+	enabled     bool
+	aboveRadius int
+	belowRadius int
+	debounce    time.Duration
+	cppURL      string
+	geoCppURL   string
+	heuristics  []v1.CppConfigResponse_Heuristic
+}
+
+func defaultCppSettings() cppSettings {
+	return cppSettings{
+		enabled:     true,
+		aboveRadius: 50,
+		belowRadius: 50,
+		debounce:    75 * time.Millisecond,
+	}
+}
+
+func cppSettingsFrom(resp *v1.CppConfigResponse) cppSettings {
+	settings := defaultCppSettings()
+
+	if resp.IsOn != nil {
+		settings.enabled = *resp.IsOn
+	}
+	if resp.AboveRadius != nil && *resp.AboveRadius > 0 {
+		settings.aboveRadius = int(*resp.AboveRadius)
+	}
+	if resp.BelowRadius != nil && *resp.BelowRadius > 0 {
+		settings.belowRadius = int(*resp.BelowRadius)
+	}
+	if resp.ClientDebounceDurationMillis > 0 {
+		settings.debounce = time.Duration(resp.ClientDebounceDurationMillis) * time.Millisecond
+	}
+
+	settings.cppURL = strings.TrimSuffix(resp.CppUrl, "/")
+	settings.geoCppURL = strings.TrimSuffix(resp.GeoCppBackendUrl, "/")
+	settings.heuristics = resp.Heuristics
+
+	return settings
+}
+
+func (c cppSettings) hasHeuristic(h v1.CppConfigResponse_Heuristic) bool {
+	return slices.Contains(c.heuristics, h)
+}
+
+// cppConfigStore holds the latest cppSettings.
+type cppConfigStore struct {
+	mu       sync.RWMutex
+	settings cppSettings
+}
+
+func newCppConfigStore() *cppConfigStore {
+	return &cppConfigStore{settings: defaultCppSettings()}
+}
+
+func (c *cppConfigStore) get() cppSettings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.settings
+}
+
+func (c *cppConfigStore) set(settings cppSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.settings = settings
+}
+
+// fetchCppConfig asks the server for the tab config. On failure the current
+// settings are kept, which are the defaults until a fetch succeeds.
+func (s *state) fetchCppConfig(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.timeout())
+	defer cancel()
+
+	req := newRequest(s.cfg, s.tokens.token(ctx), s.machine, &v1.CppConfigRequest{})
+
+	resp, err := s.endpoints.api.client.CppConfig(ctx, req)
+	if err != nil {
+		s.reporter.report("fetching cpp config, keeping current settings", err)
+		return
+	}
+
+	settings := cppSettingsFrom(resp.Msg)
+	log.Printf("cpp config: %+v", settings)
+
+	s.cppConfig.set(settings)
+
+	// prefer the geo routed backend over the generic cpp host
+	url := settings.geoCppURL
+	if url == "" {
+		url = settings.cppURL
+	}
+
+	if ep := s.endpoints.setCppURL(url, s.cfg.cppTimeout()); ep != nil {
+		s.checkHealth(ctx, ep)
+	}
+}
+
+// watchCppConfig fetches the tab config now and then periodically until ctx
+// is done.
+func (s *state) watchCppConfig(ctx context.Context) {
+	s.fetchCppConfig(ctx)
+
+	ticker := time.NewTicker(cppConfigRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.fetchCppConfig(ctx)
+		}
+	}
+}
+
+// rejectedByHeuristics applies the server-enabled suggestion heuristics to a
+// suggestion replacing oldLines with newLines, where after is the line that
+// follows the replaced range.
+func (c cppSettings) rejectedByHeuristics(oldLines, newLines []string, after *string) (v1.CppConfigResponse_Heuristic, bool) {
+	if c.hasHeuristic(v1.CppConfigResponse_HEURISTIC_LOTS_OF_ADDED_TEXT) && len(newLines)-len(oldLines) > lotsOfAddedTextLines {
+		return v1.CppConfigResponse_HEURISTIC_LOTS_OF_ADDED_TEXT, true
+	}
+
+	if c.hasHeuristic(v1.CppConfigResponse_HEURISTIC_DUPLICATING_LINE_AFTER_SUGGESTION) && after != nil && len(newLines) > 0 {
+		last := strings.TrimSpace(newLines[len(newLines)-1])
+		if last != "" && last == strings.TrimSpace(*after) {
+			return v1.CppConfigResponse_HEURISTIC_DUPLICATING_LINE_AFTER_SUGGESTION, true
+		}
+	}
+
+	return 0, false
+}
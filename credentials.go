@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// stateDBOverrideEnv names the environment variable that points at an
+// explicit state.vscdb, bypassing the per-platform search.
+const stateDBOverrideEnv = "CURSORTAB_STATE_DB"
+
+// errStateDBNotFound is returned when none of the candidate locations hold a
+// Cursor state database.
+type errStateDBNotFound struct {
+	tried []string
+}
+
+func (e *errStateDBNotFound) Error() string {
+	return fmt.Sprintf("cursor state database not found, tried: %s", strings.Join(e.tried, ", "))
+}
+
+// stateDBCandidates lists the places Cursor keeps its global state database
+// for the given platform, most specific first. An explicit override replaces
+// the search entirely so a typo doesn't silently pick up another install.
+func stateDBCandidates(goos, home, override string) []string {
+	if override != "" {
+		return []string{override}
+	}
+
+	var candidates []string
+
+	rel := filepath.Join("Cursor", "User", "globalStorage", "state.vscdb")
+
+	switch goos {
+	case "darwin":
+		candidates = append(candidates, filepath.Join(home, "Library", "Application Support", rel))
+	case "windows":
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			candidates = append(candidates, filepath.Join(appData, rel))
+		}
+		candidates = append(candidates, filepath.Join(home, "AppData", "Roaming", rel))
+	default:
+		if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+			candidates = append(candidates, filepath.Join(xdg, rel))
+		}
+		candidates = append(candidates, filepath.Join(home, ".config", rel))
+	}
+
+	return candidates
+}
+
+// findStateDB returns the first candidate state database that exists.
+func findStateDB(override string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.Getenv("HOME")
+	}
+
+	return locateStateDB(stateDBCandidates(runtime.GOOS, home, override))
+}
+
+func locateStateDB(candidates []string) (string, error) {
+	tried := make([]string, 0, len(candidates))
+
+	for _, path := range candidates {
+		if len(tried) > 0 && tried[len(tried)-1] == path {
+			continue
+		}
+		tried = append(tried, path)
+
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		return path, nil
+	}
+
+	return "", &errStateDBNotFound{tried: tried}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStateDBCandidates(t *testing.T) {
+	rel := filepath.Join("Cursor", "User", "globalStorage", "state.vscdb")
+
+	tests := []struct {
+		name     string
+		goos     string
+		xdg      string
+		appData  string
+		override string
+		want     []string
+	}{
+		{
+			name: "linux",
+			goos: "linux",
+			want: []string{filepath.Join("/home/u", ".config", rel)},
+		},
+		{
+			name: "linux with XDG_CONFIG_HOME",
+			goos: "linux",
+			xdg:  "/xdg",
+			want: []string{filepath.Join("/xdg", rel), filepath.Join("/home/u", ".config", rel)},
+		},
+		{
+			name:    "darwin ignores XDG_CONFIG_HOME and APPDATA",
+			goos:    "darwin",
+			xdg:     "/xdg",
+			appData: "/appdata",
+			want:    []string{filepath.Join("/home/u", "Library", "Application Support", rel)},
+		},
+		{
+			name: "windows",
+			goos: "windows",
+			want: []string{filepath.Join("/home/u", "AppData", "Roaming", rel)},
+		},
+		{
+			name:    "windows with APPDATA",
+			goos:    "windows",
+			appData: "/appdata",
+			want:    []string{filepath.Join("/appdata", rel), filepath.Join("/home/u", "AppData", "Roaming", rel)},
+		},
+		{
+			name:     "override replaces the search",
+			goos:     "linux",
+			xdg:      "/xdg",
+			override: "/elsewhere/state.vscdb",
+			want:     []string{"/elsewhere/state.vscdb"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", tt.xdg)
+			t.Setenv("APPDATA", tt.appData)
+
+			got := stateDBCandidates(tt.goos, "/home/u", tt.override)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("stateDBCandidates() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocateStateDB(t *testing.T) {
+	rel := filepath.Join("Cursor", "User", "globalStorage", "state.vscdb")
+
+	tests := []struct {
+		name     string
+		goos     string
+		useXDG   bool
+		create   []string
+		override string
+		want     string
+	}{
+		{
+			name:   "home config",
+			goos:   "linux",
+			create: []string{filepath.Join("home", ".config", rel)},
+			want:   filepath.Join("home", ".config", rel),
+		},
+		{
+			name:   "XDG_CONFIG_HOME wins over home",
+			goos:   "linux",
+			useXDG: true,
+			create: []string{filepath.Join("xdg", rel), filepath.Join("home", ".config", rel)},
+			want:   filepath.Join("xdg", rel),
+		},
+		{
+			name:   "falls back to home when XDG_CONFIG_HOME has none",
+			goos:   "linux",
+			useXDG: true,
+			create: []string{filepath.Join("home", ".config", rel)},
+			want:   filepath.Join("home", ".config", rel),
+		},
+		{
+			name:   "darwin",
+			goos:   "darwin",
+			create: []string{filepath.Join("home", "Library", "Application Support", rel)},
+			want:   filepath.Join("home", "Library", "Application Support", rel),
+		},
+		{
+			name:   "windows APPDATA",
+			goos:   "windows",
+			create: []string{filepath.Join("appdata", rel)},
+			want:   filepath.Join("appdata", rel),
+		},
+		{
+			name:     "override",
+			goos:     "linux",
+			create:   []string{filepath.Join("home", ".config", rel), "custom.vscdb"},
+			override: "custom.vscdb",
+			want:     "custom.vscdb",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			home := filepath.Join(root, "home")
+
+			t.Setenv("HOME", home)
+			t.Setenv("APPDATA", filepath.Join(root, "appdata"))
+			t.Setenv("XDG_CONFIG_HOME", "")
+			if tt.useXDG {
+				t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "xdg"))
+			}
+
+			for _, rel := range tt.create {
+				writeFixture(t, filepath.Join(root, rel))
+			}
+
+			override := ""
+			if tt.override != "" {
+				override = filepath.Join(root, tt.override)
+			}
+
+			got, err := locateStateDB(stateDBCandidates(tt.goos, home, override))
+			if err != nil {
+				t.Fatalf("locateStateDB() error = %v", err)
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Errorf("locateStateDB() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLocateStateDBNotFound(t *testing.T) {
+	root := t.TempDir()
+	home := filepath.Join(root, "home")
+
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "xdg"))
+
+	// a directory where the database should be doesn't count
+	if err := os.MkdirAll(filepath.Join(home, ".config", "Cursor", "User", "globalStorage", "state.vscdb"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := stateDBCandidates("linux", home, "")
+
+	_, err := locateStateDB(candidates)
+
+	var notFound *errStateDBNotFound
+	if !errors.As(err, &notFound) {
+		t.Fatalf("locateStateDB() error = %v, want errStateDBNotFound", err)
+	}
+	if !slices.Equal(notFound.tried, candidates) {
+		t.Errorf("tried = %q, want %q", notFound.tried, candidates)
+	}
+	for _, path := range candidates {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("error %q doesn't mention %s", err, path)
+		}
+	}
+}
+
+func TestFindStateDBUsesHome(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("home comes from USERPROFILE on windows")
+	}
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	candidates := stateDBCandidates(runtime.GOOS, home, "")
+	want := candidates[len(candidates)-1]
+	writeFixture(t, want)
+
+	got, err := findStateDB("")
+	if err != nil {
+		t.Fatalf("findStateDB() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("findStateDB() = %q, want %q", got, want)
+	}
+}
+
+func writeFixture(t *testing.T, path string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	"sort"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// maxDiagnostics caps how many diagnostics are sent with a request, keeping
+// the most severe ones closest to the cursor.
+const maxDiagnostics = 50
+
+// diagnosticsLua flattens vim.diagnostic.get() for a buffer, including the
+// relatedInformation LSP clients stash in user_data. Related locations in
+// other files are left out, since only ranges in this file are sent.
+const diagnosticsLua = `
+local bufnr = ...
+local name = vim.api.nvim_buf_get_name(bufnr)
+local out = {}
+for _, d in ipairs(vim.diagnostic.get(bufnr)) do
+	local related = {}
+	local lsp = d.user_data and d.user_data.lsp
+	if lsp and lsp.relatedInformation then
+		for _, info in ipairs(lsp.relatedInformation) do
+			local ok, fname = pcall(vim.uri_to_fname, info.location.uri)
+			if ok and fname == name then
+				local r = info.location.range
+				table.insert(related, {
+					message = info.message,
+					lnum = r.start.line,
+					col = r.start.character,
+					end_lnum = r["end"].line,
+					end_col = r["end"].character,
+				})
+			end
+		end
+	end
+	table.insert(out, {
+		lnum = d.lnum,
+		col = d.col,
+		end_lnum = d.end_lnum or d.lnum,
+		end_col = d.end_col or d.col,
+		severity = d.severity,
+		message = d.message,
+		source = d.source or "",
+		related = related,
+	})
+end
+return out
+`
+
+// diagnostic is one entry of vim.diagnostic.get(), with 0 based positions.
+type diagnostic struct {
+	Lnum     int                 `msgpack:"lnum"`
+	Col      int                 `msgpack:"col"`
+	EndLnum  int                 `msgpack:"end_lnum"`
+	EndCol   int                 `msgpack:"end_col"`
+	Severity int                 `msgpack:"severity"`
+	Message  string              `msgpack:"message"`
+	Source   string              `msgpack:"source"`
+	Related  []relatedDiagnostic `msgpack:"related"`
+}
+
+// relatedDiagnostic is a relatedInformation entry in the same file.
+type relatedDiagnostic struct {
+	Message string `msgpack:"message"`
+	Lnum    int    `msgpack:"lnum"`
+	Col     int    `msgpack:"col"`
+	EndLnum int    `msgpack:"end_lnum"`
+	EndCol  int    `msgpack:"end_col"`
+}
+
+// bufferDiagnostics fetches the diagnostics of buf from Neovim.
+func (s *state) bufferDiagnostics(buf nvim.Buffer) ([]diagnostic, error) {
+	var diags []diagnostic
+	if err := s.v.ExecLua(diagnosticsLua, &diags, buf); err != nil {
+		return nil, err
+	}
+
+	return diags, nil
+}
+
+// cursorPosition converts a 0 based line and column into the position the
+// server expects, which has 1 based lines.
+func cursorPosition(line, col int) *v1.CursorPosition {
+	return &v1.CursorPosition{
+		Line:   int32(line + 1),
+		Column: int32(col),
+	}
+}
+
+func cursorRange(lnum, col, endLnum, endCol int) *v1.CursorRange {
+	return &v1.CursorRange{
+		StartPosition: cursorPosition(lnum, col),
+		EndPosition:   cursorPosition(endLnum, endCol),
+	}
+}
+
+// rankDiagnostics orders diags by severity, then by distance from line, and
+// drops everything past maxDiagnostics. vim.diagnostic severities run from
+// 1 (error) to 4 (hint), so lower is more severe.
+func rankDiagnostics(diags []diagnostic, line int) []diagnostic {
+	ranked := append([]diagnostic(nil), diags...)
+
+	distance := func(d diagnostic) int {
+		if line < d.Lnum {
+			return d.Lnum - line
+		}
+		if line > d.EndLnum {
+			return line - d.EndLnum
+		}
+		return 0
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Severity != ranked[j].Severity {
+			return ranked[i].Severity < ranked[j].Severity
+		}
+		return distance(ranked[i]) < distance(ranked[j])
+	})
+
+	if len(ranked) > maxDiagnostics {
+		ranked = ranked[:maxDiagnostics]
+	}
+
+	return ranked
+}
+
+// linterErrors maps diagnostics to the LinterErrors of a StreamCppRequest.
+// The vim.diagnostic severities line up with the proto enum values.
+func linterErrors(path, contents string, diags []diagnostic) *v1.LinterErrors {
+	if len(diags) == 0 {
+		return nil
+	}
+
+	errs := &v1.LinterErrors{
+		RelativeWorkspacePath: path,
+		FileContents:          contents,
+	}
+
+	for _, d := range diags {
+		linterErr := &v1.LinterError{
+			Message: d.Message,
+			Range:   cursorRange(d.Lnum, d.Col, d.EndLnum, d.EndCol),
+		}
+
+		if d.Source != "" {
+			source := d.Source
+			linterErr.Source = &source
+		}
+
+		if d.Severity >= 1 && d.Severity <= 4 {
+			severity := v1.LinterError_DiagnosticSeverity(d.Severity)
+			linterErr.Severity = &severity
+		}
+
+		for _, r := range d.Related {
+			linterErr.RelatedInformation = append(linterErr.RelatedInformation, &v1.LinterError_RelatedInformation{
+				Message: r.Message,
+				Range:   cursorRange(r.Lnum, r.Col, r.EndLnum, r.EndCol),
+			})
+		}
+
+		errs.Errors = append(errs.Errors, linterErr)
+	}
+
+	return errs
+}
+
+// fileDiagnostics maps diagnostics to CurrentFileInfo.Diagnostics.
+func fileDiagnostics(diags []diagnostic) []*v1.Diagnostic {
+	out := make([]*v1.Diagnostic, 0, len(diags))
+
+	for _, d := range diags {
+		diag := &v1.Diagnostic{
+			Message: d.Message,
+			Range:   cursorRange(d.Lnum, d.Col, d.EndLnum, d.EndCol),
+		}
+
+		if d.Severity >= 1 && d.Severity <= 4 {
+			diag.Severity = v1.Diagnostic_DiagnosticSeverity(d.Severity)
+		}
+
+		for _, r := range d.Related {
+			diag.RelatedInformation = append(diag.RelatedInformation, &v1.Diagnostic_RelatedInformation{
+				Message: r.Message,
+				Range:   cursorRange(r.Lnum, r.Col, r.EndLnum, r.EndCol),
+			})
+		}
+
+		out = append(out, diag)
+	}
+
+	return out
+}
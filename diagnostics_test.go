@@ -0,0 +1,158 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	"slices"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var diagnosticFixtures = []diagnostic{
+	{Lnum: 40, Col: 2, EndLnum: 40, EndCol: 8, Severity: 2, Message: "unused variable", Source: "gopls"},
+	{Lnum: 3, Col: 0, EndLnum: 5, EndCol: 1, Severity: 1, Message: "missing return", Related: []relatedDiagnostic{
+		{Message: "function starts here", Lnum: 1, Col: 5, EndLnum: 1, EndCol: 9},
+	}},
+	{Lnum: 12, Col: 4, EndLnum: 12, EndCol: 6, Severity: 1, Message: "undefined: x", Source: "compiler"},
+	{Lnum: 11, Col: 0, EndLnum: 11, EndCol: 3, Severity: 4, Message: "hint"},
+	{Lnum: 0, Col: 0, EndLnum: 0, EndCol: 0, Severity: 0, Message: "no severity"},
+}
+
+func TestRankDiagnostics(t *testing.T) {
+	// severity 0 isn't a vim.diagnostic severity and sorts first
+	tests := []struct {
+		name string
+		line int
+		want []string
+	}{
+		{
+			name: "severity first, then distance",
+			line: 10,
+			want: []string{"no severity", "undefined: x", "missing return", "unused variable", "hint"},
+		},
+		{
+			name: "inside a multi line range is distance 0",
+			line: 4,
+			want: []string{"no severity", "missing return", "undefined: x", "unused variable", "hint"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range rankDiagnostics(diagnosticFixtures, tt.line) {
+				got = append(got, d.Message)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("rankDiagnostics() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRankDiagnosticsCaps(t *testing.T) {
+	diags := make([]diagnostic, maxDiagnostics+10)
+	for i := range diags {
+		diags[i] = diagnostic{Lnum: i, EndLnum: i, Severity: 2}
+	}
+	diags[len(diags)-1].Severity = 1
+
+	ranked := rankDiagnostics(diags, 0)
+	if len(ranked) != maxDiagnostics {
+		t.Fatalf("len(rankDiagnostics()) = %d, want %d", len(ranked), maxDiagnostics)
+	}
+	if ranked[0].Lnum != len(diags)-1 {
+		t.Errorf("most severe diagnostic dropped or not first: %+v", ranked[0])
+	}
+	if ranked[len(ranked)-1].Lnum != maxDiagnostics-2 {
+		t.Errorf("last kept = line %d, want %d", ranked[len(ranked)-1].Lnum, maxDiagnostics-2)
+	}
+
+	if diags[0].Lnum != 0 {
+		t.Errorf("rankDiagnostics() reordered its input")
+	}
+}
+
+func TestLinterErrors(t *testing.T) {
+	if got := linterErrors("a.go", "package a", nil); got != nil {
+		t.Errorf("linterErrors() without diagnostics = %v, want nil", got)
+	}
+
+	errorSeverity := v1.LinterError_DiagnosticSeverity(1)
+	warningSeverity := v1.LinterError_DiagnosticSeverity(2)
+	gopls := "gopls"
+
+	want := &v1.LinterErrors{
+		RelativeWorkspacePath: "a.go",
+		FileContents:          "package a",
+		Errors: []*v1.LinterError{
+			{
+				Message:  "unused variable",
+				Range:    cursorRange(40, 2, 40, 8),
+				Source:   &gopls,
+				Severity: &warningSeverity,
+			},
+			{
+				Message:  "missing return",
+				Range:    cursorRange(3, 0, 5, 1),
+				Severity: &errorSeverity,
+				RelatedInformation: []*v1.LinterError_RelatedInformation{
+					{Message: "function starts here", Range: cursorRange(1, 5, 1, 9)},
+				},
+			},
+			{
+				Message: "no severity",
+				Range:   cursorRange(0, 0, 0, 0),
+			},
+		},
+	}
+
+	diags := []diagnostic{diagnosticFixtures[0], diagnosticFixtures[1], diagnosticFixtures[4]}
+	if got := linterErrors("a.go", "package a", diags); !proto.Equal(got, want) {
+		t.Errorf("linterErrors() = %v, want %v", got, want)
+	}
+}
+
+func TestFileDiagnostics(t *testing.T) {
+	want := []*v1.Diagnostic{
+		{
+			Message:  "missing return",
+			Range:    cursorRange(3, 0, 5, 1),
+			Severity: v1.Diagnostic_DiagnosticSeverity(1),
+			RelatedInformation: []*v1.Diagnostic_RelatedInformation{
+				{Message: "function starts here", Range: cursorRange(1, 5, 1, 9)},
+			},
+		},
+		{
+			Message:  "hint",
+			Range:    cursorRange(11, 0, 11, 3),
+			Severity: v1.Diagnostic_DiagnosticSeverity(4),
+		},
+		{
+			Message: "no severity",
+			Range:   cursorRange(0, 0, 0, 0),
+		},
+	}
+
+	got := fileDiagnostics([]diagnostic{diagnosticFixtures[1], diagnosticFixtures[3], diagnosticFixtures[4]})
+	if len(got) != len(want) {
+		t.Fatalf("fileDiagnostics() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if !proto.Equal(got[i], want[i]) {
+			t.Errorf("fileDiagnostics()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if got := fileDiagnostics(nil); len(got) != 0 {
+		t.Errorf("fileDiagnostics(nil) = %v, want none", got)
+	}
+}
+
+func TestCursorRangeIsOneBased(t *testing.T) {
+	r := cursorRange(0, 3, 2, 7)
+	if r.StartPosition.Line != 1 || r.StartPosition.Column != 3 || r.EndPosition.Line != 3 || r.EndPosition.Column != 7 {
+		t.Errorf("cursorRange() = %v", r)
+	}
+}
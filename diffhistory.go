@@ -0,0 +1,216 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDiffsPerFile caps how many diffs we keep for a single file.
+	maxDiffsPerFile = 10
+
+	// maxDiffFiles caps how many files we keep history for, dropping the
+	// least recently edited first.
+	maxDiffFiles = 20
+
+	// diffMergeWindow is how long consecutive edits to the same lines are
+	// folded into one diff, so typing a word doesn't produce one entry per
+	// keystroke.
+	diffMergeWindow = 2 * time.Second
+)
+
+type diffEntry struct {
+	diff string
+	at   time.Time
+
+	// base is the snapshot the diff was computed against and first/last the
+	// new line range it touched, kept so later edits can be merged in. Only
+	// the latest entry can be merged into, so older ones drop their base.
+	base        []string
+	first, last int
+}
+
+type fileDiffHistory struct {
+	snapshot []string
+	entries  []diffEntry
+	edited   time.Time
+}
+
+// diffRecorder snapshots each file as it is synced and records line diffs
+// between consecutive versions in the N-|/N+| format the server expects.
+// History is keyed by path, so it survives switching buffers.
+type diffRecorder struct {
+	mu    sync.Mutex
+	files map[string]*fileDiffHistory
+	now   func() time.Time
+}
+
+func newDiffRecorder() *diffRecorder {
+	return &diffRecorder{
+		files: map[string]*fileDiffHistory{},
+		now:   time.Now,
+	}
+}
+
+// record snapshots lines as the latest version of path and reports whether
+// they differ from the previous snapshot.
+func (r *diffRecorder) record(path string, lines []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+
+	file, ok := r.files[path]
+	if !ok {
+		r.files[path] = &fileDiffHistory{snapshot: lines, edited: now}
+		r.evictLocked()
+		return false
+	}
+
+	first, oldLast, newLast, changed := changedRange(file.snapshot, lines)
+	if !changed {
+		return false
+	}
+
+	base := file.snapshot
+	if n := len(file.entries); n > 0 {
+		prev := file.entries[n-1]
+		if now.Sub(prev.at) < diffMergeWindow && first <= prev.last+1 && oldLast >= prev.first-1 {
+			base = prev.base
+			file.entries = file.entries[:n-1]
+			first, _, newLast, changed = changedRange(base, lines)
+		}
+	}
+
+	if changed {
+		if n := len(file.entries); n > 0 {
+			file.entries[n-1].base = nil
+		}
+		file.entries = append(file.entries, diffEntry{
+			diff:  formatLineDiff(base, lines),
+			at:    now,
+			base:  base,
+			first: first,
+			last:  newLast,
+		})
+		if len(file.entries) > maxDiffsPerFile {
+			file.entries = file.entries[len(file.entries)-maxDiffsPerFile:]
+		}
+	}
+
+	file.snapshot = lines
+	file.edited = now
+
+	return true
+}
+
+// history returns the recorded diffs of path, oldest first.
+func (r *diffRecorder) history(path string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file, ok := r.files[path]
+	if !ok {
+		return nil
+	}
+
+	diffs := make([]string, len(file.entries))
+	for i, entry := range file.entries {
+		diffs[i] = entry.diff
+	}
+
+	return diffs
+}
+
+// fileHistories returns the history of every file with recorded diffs,
+// most recently edited first, for CppFileDiffHistory. Paths are sent
+// relative to ws.
+func (r *diffRecorder) fileHistories(ws workspace) []*v1.CppFileDiffHistory {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	paths := make([]string, 0, len(r.files))
+	for path, file := range r.files {
+		if len(file.entries) > 0 {
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		return r.files[paths[i]].edited.After(r.files[paths[j]].edited)
+	})
+
+	histories := make([]*v1.CppFileDiffHistory, len(paths))
+	for i, path := range paths {
+		file := r.files[path]
+
+		history := &v1.CppFileDiffHistory{FileName: ws.relative(path)}
+		for _, entry := range file.entries {
+			history.DiffHistory = append(history.DiffHistory, entry.diff)
+			history.DiffHistoryTimestamps = append(history.DiffHistoryTimestamps, float64(entry.at.UnixMilli()))
+		}
+
+		histories[i] = history
+	}
+
+	return histories
+}
+
+func (r *diffRecorder) evictLocked() {
+	for len(r.files) > maxDiffFiles {
+		var oldest string
+		var oldestAt time.Time
+
+		for path, file := range r.files {
+			if oldest == "" || file.edited.Before(oldestAt) {
+				oldest, oldestAt = path, file.edited
+			}
+		}
+
+		delete(r.files, oldest)
+	}
+}
+
+// changedRange trims the common prefix and suffix of a and b. first is the
+// first differing line and oldLast/newLast the last differing line in a and
+// b respectively (first-1 for a pure insertion or deletion).
+func changedRange(a, b []string) (first, oldLast, newLast int, changed bool) {
+	for first < len(a) && first < len(b) && a[first] == b[first] {
+		first++
+	}
+
+	if first == len(a) && first == len(b) {
+		return 0, 0, 0, false
+	}
+
+	oldLast, newLast = len(a)-1, len(b)-1
+	for oldLast >= first && newLast >= first && a[oldLast] == b[newLast] {
+		oldLast--
+		newLast--
+	}
+
+	return first, oldLast, newLast, true
+}
+
+// formatLineDiff renders the lines that changed between a and b, removed
+// lines numbered as in a and added lines numbered as in b, both 1 based.
+func formatLineDiff(a, b []string) string {
+	first, oldLast, newLast, changed := changedRange(a, b)
+	if !changed {
+		return ""
+	}
+
+	var sb strings.Builder
+	for i := first; i <= oldLast; i++ {
+		fmt.Fprintf(&sb, "%d-|%s\n", i+1, a[i])
+	}
+	for i := first; i <= newLast; i++ {
+		fmt.Fprintf(&sb, "%d+|%s\n", i+1, b[i])
+	}
+
+	return sb.String()
+}
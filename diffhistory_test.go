@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestDiffRecorder returns a recorder whose clock only moves with
+// advance.
+func newTestDiffRecorder() (*diffRecorder, func(time.Duration)) {
+	r := newDiffRecorder()
+	now := time.Unix(1_700_000_000, 0)
+	r.now = func() time.Time { return now }
+
+	return r, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestFormatLineDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want string
+	}{
+		{name: "unchanged", a: []string{"a"}, b: []string{"a"}, want: ""},
+		{name: "changed line", a: []string{"a", "b", "c"}, b: []string{"a", "B", "c"}, want: "2-|b\n2+|B\n"},
+		{name: "insertion", a: []string{"a", "c"}, b: []string{"a", "b", "c"}, want: "2+|b\n"},
+		{name: "deletion", a: []string{"a", "b", "c"}, b: []string{"a", "c"}, want: "2-|b\n"},
+		{name: "repeated lines", a: []string{"x", "x"}, b: []string{"x", "x", "x"}, want: "3+|x\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatLineDiff(tt.a, tt.b); got != tt.want {
+				t.Errorf("formatLineDiff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffRecorderMerge(t *testing.T) {
+	tests := []struct {
+		name  string
+		edits [][]string
+		gap   time.Duration
+		want  []string
+	}{
+		{
+			name:  "typing within the window",
+			edits: [][]string{{"a", "x"}, {"ab", "x"}, {"abc", "x"}},
+			gap:   diffMergeWindow / 2,
+			want:  []string{"1-|a\n1+|abc\n"},
+		},
+		{
+			name:  "pauses outside the window",
+			edits: [][]string{{"a", "x"}, {"ab", "x"}, {"abc", "x"}},
+			gap:   diffMergeWindow,
+			want:  []string{"1-|a\n1+|ab\n", "1-|ab\n1+|abc\n"},
+		},
+		{
+			name:  "adjacent lines merge",
+			edits: [][]string{{"a", "b"}, {"A", "b"}, {"A", "B"}},
+			gap:   diffMergeWindow / 2,
+			want:  []string{"1-|a\n2-|b\n1+|A\n2+|B\n"},
+		},
+		{
+			name:  "distant lines don't",
+			edits: [][]string{{"a", "x", "y", "b"}, {"A", "x", "y", "b"}, {"A", "x", "y", "B"}},
+			gap:   diffMergeWindow / 2,
+			want:  []string{"1-|a\n1+|A\n", "4-|b\n4+|B\n"},
+		},
+		{
+			name:  "edits that cancel out",
+			edits: [][]string{{"a"}, {"ab"}, {"a"}},
+			gap:   diffMergeWindow / 2,
+			want:  nil,
+		},
+		{
+			name:  "undone edit merges with the one before",
+			edits: [][]string{{"a", "b"}, {"A", "b"}, {"A", "bc"}, {"A", "b"}},
+			gap:   diffMergeWindow / 2,
+			want:  []string{"1-|a\n1+|A\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, advance := newTestDiffRecorder()
+
+			for i, lines := range tt.edits {
+				changed := r.record("/ws/a.go", lines)
+				if want := i > 0; changed != want {
+					t.Errorf("record() of edit %d = %v, want %v", i, changed, want)
+				}
+				advance(tt.gap)
+			}
+
+			if got := r.history("/ws/a.go"); !slices.Equal(got, tt.want) {
+				t.Errorf("history() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffRecorderKeepsBaseOnlyOnLatest(t *testing.T) {
+	r, advance := newTestDiffRecorder()
+
+	for _, lines := range [][]string{{"a"}, {"b"}, {"c"}, {"d"}} {
+		r.record("/ws/a.go", lines)
+		advance(diffMergeWindow)
+	}
+
+	entries := r.files["/ws/a.go"].entries
+	if len(entries) != 3 {
+		t.Fatalf("%d entries, want 3", len(entries))
+	}
+	for i, entry := range entries[:len(entries)-1] {
+		if entry.base != nil {
+			t.Errorf("entry %d still holds its base", i)
+		}
+	}
+	if base := entries[len(entries)-1].base; !slices.Equal(base, []string{"c"}) {
+		t.Errorf("latest base = %q, want [c]", base)
+	}
+}
+
+func TestDiffRecorderCapsEntriesPerFile(t *testing.T) {
+	r, advance := newTestDiffRecorder()
+
+	for i := range maxDiffsPerFile + 3 {
+		r.record("/ws/a.go", []string{fmt.Sprint(i)})
+		advance(diffMergeWindow)
+	}
+
+	got := r.history("/ws/a.go")
+	if len(got) != maxDiffsPerFile {
+		t.Fatalf("%d entries, want %d", len(got), maxDiffsPerFile)
+	}
+	if want := "1-|2\n1+|3\n"; got[0] != want {
+		t.Errorf("oldest kept = %q, want %q", got[0], want)
+	}
+}
+
+func TestDiffRecorderCapsFiles(t *testing.T) {
+	r, advance := newTestDiffRecorder()
+
+	path := func(i int) string { return fmt.Sprintf("/ws/%d.go", i) }
+
+	for i := range maxDiffFiles + 1 {
+		r.record(path(i), []string{"a"})
+		r.record(path(i), []string{"b"})
+		advance(time.Second)
+	}
+
+	if len(r.files) != maxDiffFiles {
+		t.Errorf("%d files kept, want %d", len(r.files), maxDiffFiles)
+	}
+	if got := r.history(path(0)); got != nil {
+		t.Errorf("least recently edited file kept: %q", got)
+	}
+
+	histories := r.fileHistories(workspace{Root: "/ws"})
+	if len(histories) != maxDiffFiles {
+		t.Fatalf("%d histories, want %d", len(histories), maxDiffFiles)
+	}
+	if got, want := histories[0].FileName, fmt.Sprintf("%d.go", maxDiffFiles); got != want {
+		t.Errorf("most recent history = %s, want %s", got, want)
+	}
+	if ts := histories[0].DiffHistoryTimestamps; len(ts) != 1 || ts[0] <= histories[1].DiffHistoryTimestamps[0] {
+		t.Errorf("timestamps %v not newer than %v", ts, histories[1].DiffHistoryTimestamps)
+	}
+}
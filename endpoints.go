@@ -0,0 +1,166 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	aiserverv1connect "connectrpc/cursor/gen/v1/aiserverv1connect"
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// endpointHealthInterval is how often the API and cpp hosts are probed.
+const endpointHealthInterval = time.Minute
+
+// endpoint is one backend host with its own HTTP/2 connection pool and
+// request timeout.
+type endpoint struct {
+	url     string
+	client  aiserverv1connect.AiServiceClient
+	timeout time.Duration
+	healthy atomic.Bool
+}
+
+func newEndpoint(url string, timeout time.Duration) *endpoint {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+
+	e := &endpoint{
+		url:     url,
+		client:  aiserverv1connect.NewAiServiceClient(&http.Client{Transport: transport}, url),
+		timeout: timeout,
+	}
+	e.healthy.Store(true)
+
+	return e
+}
+
+// endpoints routes RPCs between the API host and the low latency cpp host
+// the server hands out in CppConfig. Completion and cursor prediction go to
+// the cpp host while it passes health checks, everything else to the API.
+type endpoints struct {
+	api *endpoint
+
+	mu  sync.RWMutex
+	cpp *endpoint
+}
+
+func newEndpoints(cfg *config) *endpoints {
+	return &endpoints{api: newEndpoint(cfg.BaseURL, cfg.timeout())}
+}
+
+// completions returns the endpoint StreamCpp and StreamNextCursorPrediction
+// should use.
+func (e *endpoints) completions() *endpoint {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.cpp != nil && e.cpp.healthy.Load() {
+		return e.cpp
+	}
+
+	return e.api
+}
+
+// setCppURL points completions at url, or back at the API host if url is
+// empty. The returned endpoint is nil if no separate cpp host is in use.
+func (e *endpoints) setCppURL(url string, timeout time.Duration) *endpoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if url == "" || url == e.api.url {
+		e.cpp = nil
+		return nil
+	}
+
+	if e.cpp == nil || e.cpp.url != url || e.cpp.timeout != timeout {
+		log.Printf("routing completions to %s", url)
+		e.cpp = newEndpoint(url, timeout)
+	}
+
+	return e.cpp
+}
+
+// failed takes the cpp host out of rotation after a completion on ep failed
+// with a network error, so the next request goes to the API host instead
+// of waiting for the health check to notice. It reports whether that
+// changed anything; the API host has nothing to fall back to and stays.
+func (e *endpoints) failed(ep *endpoint, err error) bool {
+	if ep == e.api {
+		return false
+	}
+
+	if category, ok := classifyError(err); !ok || category != errorNetwork {
+		return false
+	}
+
+	if !ep.healthy.Swap(false) {
+		return false
+	}
+
+	log.Printf("%s failed, falling back to %s until it passes a health check: %v", ep.url, e.api.url, err)
+
+	return true
+}
+
+func (e *endpoints) cppEndpoint() *endpoint {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.cpp
+}
+
+// completionFailed records a failed completion or cursor prediction on ep.
+func (s *state) completionFailed(ep *endpoint, err error) {
+	if s.endpoints.failed(ep, err) {
+		s.publishStatus()
+	}
+}
+
+// checkHealth probes ep with HealthCheck and records the result.
+func (s *state) checkHealth(ctx context.Context, ep *endpoint) bool {
+	ctx, cancel := context.WithTimeout(ctx, ep.timeout)
+	defer cancel()
+
+	_, err := ep.client.HealthCheck(ctx, newRequest(s.cfg, s.tokens.token(ctx), s.machine, &v1.HealthCheckRequest{}))
+	healthy := err == nil
+
+	if was := ep.healthy.Swap(healthy); was != healthy {
+		switch {
+		case healthy:
+			log.Printf("%s is healthy again", ep.url)
+		case ep == s.endpoints.api:
+			log.Printf("%s failed health check: %v", ep.url, err)
+		default:
+			log.Printf("%s failed health check, falling back to %s: %v", ep.url, s.endpoints.api.url, err)
+		}
+
+		s.publishStatus()
+	}
+
+	return healthy
+}
+
+// watchEndpoints health checks the API and cpp hosts at startup and then
+// every endpointHealthInterval until ctx is done.
+func (s *state) watchEndpoints(ctx context.Context) {
+	ticker := time.NewTicker(endpointHealthInterval)
+	defer ticker.Stop()
+
+	// check right away, so an unreachable host shows up in the status at
+	// startup rather than a minute in
+	for {
+		s.checkHealth(ctx, s.endpoints.api)
+		if ep := s.endpoints.cppEndpoint(); ep != nil {
+			s.checkHealth(ctx, ep)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
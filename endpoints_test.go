@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+)
+
+func TestEndpointsFailover(t *testing.T) {
+	e := newEndpoints(&config{BaseURL: "https://api.example", RequestTimeout: duration(time.Second)})
+	cpp := e.setCppURL("https://cpp.example", time.Second)
+
+	if got := e.completions(); got != cpp {
+		t.Fatalf("completions() = %s, want the cpp host", got.url)
+	}
+
+	notNetwork := []error{
+		connect.NewError(connect.CodeInvalidArgument, errors.New("bad request")),
+		connect.NewError(connect.CodeUnauthenticated, errors.New("expired")),
+		context.Canceled,
+	}
+	for _, err := range notNetwork {
+		if e.failed(cpp, err) {
+			t.Errorf("failed(%v) took the cpp host out", err)
+		}
+	}
+	if got := e.completions(); got != cpp {
+		t.Fatalf("completions() = %s after non-network errors, want the cpp host", got.url)
+	}
+
+	unavailable := connect.NewError(connect.CodeUnavailable, errors.New("down"))
+
+	if e.failed(e.api, unavailable) {
+		t.Error("failed() on the API host reported a change")
+	}
+	if !e.api.healthy.Load() {
+		t.Error("API host marked unhealthy")
+	}
+
+	if !e.failed(cpp, connect.NewError(connect.CodeUnknown, &net.OpError{Op: "dial", Err: errors.New("refused")})) {
+		t.Fatal("failed() with a network error kept the cpp host")
+	}
+	if got := e.completions(); got != e.api {
+		t.Errorf("completions() = %s, want the API host", got.url)
+	}
+	if e.failed(cpp, unavailable) {
+		t.Error("failed() on an unhealthy host reported a change")
+	}
+
+	// the next passing health check brings it back
+	cpp.healthy.Store(true)
+	if got := e.completions(); got != cpp {
+		t.Errorf("completions() = %s after recovering, want the cpp host", got.url)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+)
+
+// errorCategory is the kind of failure reported to the user.
+type errorCategory string
+
+const (
+	errorAuth     errorCategory = "auth"
+	errorQuota    errorCategory = "quota"
+	errorNetwork  errorCategory = "network"
+	errorProtocol errorCategory = "protocol"
+	errorEditor   errorCategory = "editor"
+	errorConfig   errorCategory = "config"
+)
+
+// Levels understood by vim.notify, mirroring vim.log.levels.
+const (
+	logLevelWarn  = 3
+	logLevelError = 4
+)
+
+// errorRepeatInterval is how long an identical error is kept quiet after
+// being reported.
+const errorRepeatInterval = time.Minute
+
+// errorReportLua shows an error with vim.notify and fires User
+// CursorTabError, so configs can route errors elsewhere.
+const errorReportLua = `
+local category, message, level = ...
+vim.notify(message, level, { title = "cursortab" })
+vim.api.nvim_exec_autocmds("User", {
+	pattern = "CursorTabError",
+	modeline = false,
+	data = { category = category, message = message },
+})
+`
+
+// classifyError sorts err into a category. ok is false for errors that
+// aren't worth telling the user about, like a request cancelled because a
+// newer one replaced it.
+func classifyError(err error) (errorCategory, bool) {
+	if errors.Is(err, context.Canceled) {
+		return "", false
+	}
+
+	var missingKey *errStateKeyMissing
+	var notFound *errStateDBNotFound
+	if errors.Is(err, errStateDBMissing) || errors.Is(err, errStateDBLocked) || errors.As(err, &missingKey) || errors.As(err, &notFound) {
+		return errorAuth, true
+	}
+
+	var connectErr *connect.Error
+	if errors.As(err, &connectErr) {
+		switch connectErr.Code() {
+		case connect.CodeCanceled:
+			return "", false
+		case connect.CodeUnauthenticated, connect.CodePermissionDenied:
+			return errorAuth, true
+		case connect.CodeResourceExhausted:
+			return errorQuota, true
+		case connect.CodeUnavailable, connect.CodeDeadlineExceeded:
+			return errorNetwork, true
+		case connect.CodeUnknown:
+			if isNetworkError(err) {
+				return errorNetwork, true
+			}
+		}
+
+		return errorProtocol, true
+	}
+
+	if isNetworkError(err) {
+		return errorNetwork, true
+	}
+
+	return errorProtocol, true
+}
+
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type reportedError struct {
+	at         time.Time
+	suppressed int
+}
+
+// errorReporter logs failures and tells the user about them, keeping
+// repeats of the same error quiet for errorRepeatInterval.
+type errorReporter struct {
+	show func(category errorCategory, message string, level int)
+	now  func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]*reportedError
+	last lastError
+}
+
+// lastError is the most recent error reported, shown or not.
+type lastError struct {
+	category errorCategory
+	message  string
+	at       time.Time
+}
+
+func newErrorReporter(show func(category errorCategory, message string, level int)) *errorReporter {
+	return &errorReporter{
+		show: show,
+		now:  time.Now,
+		seen: map[string]*reportedError{},
+	}
+}
+
+// report logs err, which happened while doing op, and shows it to the user
+// unless it was shown recently. Network errors are warnings since they
+// usually go away on their own, and so are config errors since defaults
+// stand in.
+func (r *errorReporter) report(op string, err error) {
+	category, ok := classifyError(err)
+	if !ok {
+		log.Printf("%s: %v", op, err)
+		return
+	}
+
+	r.reportAs(category, op, err)
+}
+
+// reportAs is report for errors whose category is known up front.
+func (r *errorReporter) reportAs(category errorCategory, op string, err error) {
+	log.Printf("%s error %s: %v", category, op, err)
+
+	message := fmt.Sprintf("cursortab: %s error %s: %v", category, op, err)
+	key := string(category) + "\x00" + op + "\x00" + err.Error()
+	now := r.now()
+
+	r.mu.Lock()
+	r.last = lastError{category: category, message: fmt.Sprintf("%s: %v", op, err), at: now}
+
+	prev, ok := r.seen[key]
+	if ok && now.Sub(prev.at) < errorRepeatInterval {
+		prev.suppressed++
+		r.mu.Unlock()
+		return
+	}
+
+	if ok && prev.suppressed > 0 {
+		message += fmt.Sprintf(" (repeated %d times)", prev.suppressed)
+	}
+
+	for k, e := range r.seen {
+		if now.Sub(e.at) >= errorRepeatInterval {
+			delete(r.seen, k)
+		}
+	}
+	r.seen[key] = &reportedError{at: now}
+	r.mu.Unlock()
+
+	level := logLevelError
+	if category == errorNetwork || category == errorConfig {
+		level = logLevelWarn
+	}
+
+	r.show(category, message, level)
+}
+
+func (r *errorReporter) lastError() lastError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.last
+}
+
+// showError is the errorReporter's way of reaching Neovim.
+func (s *state) showError(category errorCategory, message string, level int) {
+	if err := s.v.ExecLua(errorReportLua, nil, string(category), message, level); err != nil {
+		log.Printf("error notifying neovim: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+)
+
+func TestClassifyError(t *testing.T) {
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name   string
+		err    error
+		want   errorCategory
+		wantOK bool
+	}{
+		{name: "cancelled", err: fmt.Errorf("streaming: %w", context.Canceled)},
+		{name: "connect cancelled", err: connect.NewError(connect.CodeCanceled, errors.New("x"))},
+		{name: "state db missing", err: fmt.Errorf("loading: %w", errStateDBMissing), want: errorAuth, wantOK: true},
+		{name: "state db locked", err: errStateDBLocked, want: errorAuth, wantOK: true},
+		{name: "state key missing", err: &errStateKeyMissing{key: "cursorAuth/accessToken"}, want: errorAuth, wantOK: true},
+		{name: "state db not found", err: &errStateDBNotFound{tried: []string{"/a"}}, want: errorAuth, wantOK: true},
+		{name: "unauthenticated", err: connect.NewError(connect.CodeUnauthenticated, errors.New("x")), want: errorAuth, wantOK: true},
+		{name: "permission denied", err: connect.NewError(connect.CodePermissionDenied, errors.New("x")), want: errorAuth, wantOK: true},
+		{name: "resource exhausted", err: connect.NewError(connect.CodeResourceExhausted, errors.New("x")), want: errorQuota, wantOK: true},
+		{name: "unavailable", err: connect.NewError(connect.CodeUnavailable, errors.New("x")), want: errorNetwork, wantOK: true},
+		{name: "deadline exceeded", err: connect.NewError(connect.CodeDeadlineExceeded, errors.New("x")), want: errorNetwork, wantOK: true},
+		{name: "unknown wrapping a network error", err: connect.NewError(connect.CodeUnknown, netErr), want: errorNetwork, wantOK: true},
+		{name: "unknown", err: connect.NewError(connect.CodeUnknown, errors.New("x")), want: errorProtocol, wantOK: true},
+		{name: "invalid argument", err: connect.NewError(connect.CodeInvalidArgument, errors.New("x")), want: errorProtocol, wantOK: true},
+		{name: "plain network error", err: fmt.Errorf("health check: %w", netErr), want: errorNetwork, wantOK: true},
+		{name: "context deadline", err: context.DeadlineExceeded, want: errorNetwork, wantOK: true},
+		{name: "anything else", err: errors.New("unexpected end of stream"), want: errorProtocol, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := classifyError(tt.err)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("classifyError() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+type shownError struct {
+	category errorCategory
+	message  string
+	level    int
+}
+
+func TestErrorReporterSuppressesRepeats(t *testing.T) {
+	var shown []shownError
+	r := newErrorReporter(func(category errorCategory, message string, level int) {
+		shown = append(shown, shownError{category, message, level})
+	})
+
+	now := time.Unix(1_700_000_000, 0)
+	r.now = func() time.Time { return now }
+
+	unavailable := connect.NewError(connect.CodeUnavailable, errors.New("down"))
+
+	r.report("streaming", unavailable)
+	now = now.Add(10 * time.Second)
+	r.report("streaming", unavailable)
+	now = now.Add(20 * time.Second)
+	r.report("streaming", unavailable)
+
+	if len(shown) != 1 {
+		t.Fatalf("shown %d times within a minute, want 1", len(shown))
+	}
+	if shown[0].category != errorNetwork || shown[0].level != logLevelWarn {
+		t.Errorf("shown %+v, want a network warning", shown[0])
+	}
+
+	if last := r.lastError(); !last.at.Equal(now) || last.category != errorNetwork {
+		t.Errorf("lastError() = %+v, want the suppressed repeat at %v", last, now)
+	}
+
+	// a different op or error isn't a repeat
+	r.report("health check", unavailable)
+	r.reportAs(errorEditor, "streaming", errors.New("no buffer"))
+	if len(shown) != 3 {
+		t.Fatalf("shown %d times, want 3", len(shown))
+	}
+	if shown[2].level != logLevelError {
+		t.Errorf("editor error level = %d, want %d", shown[2].level, logLevelError)
+	}
+
+	now = now.Add(errorRepeatInterval)
+	r.report("streaming", unavailable)
+
+	if len(shown) != 4 {
+		t.Fatalf("shown %d times after the interval, want 4", len(shown))
+	}
+	if !strings.HasSuffix(shown[3].message, "(repeated 2 times)") {
+		t.Errorf("message = %q, want the repeat count", shown[3].message)
+	}
+
+	// cancellations are only logged
+	r.report("streaming", context.Canceled)
+	if len(shown) != 4 {
+		t.Errorf("cancellation was shown")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"connectrpc.com/connect"
+)
+
+// maxFilesyncFiles caps how many files we remember the server's copy of.
+const maxFilesyncFiles = 50
+
+type syncedFile struct {
+	version  int32
+	contents string
+	used     uint64
+}
+
+// filesync remembers the last version of each file the server accepted, so
+// later requests can send just the edits since then and have the server
+// rebuild the file, instead of resending it whole.
+type filesync struct {
+	enabled bool
+
+	mu    sync.Mutex
+	files map[string]*syncedFile
+	clock uint64
+}
+
+func newFilesync(enabled bool) *filesync {
+	return &filesync{
+		enabled: enabled,
+		files:   map[string]*syncedFile{},
+	}
+}
+
+// filesyncUpload is what one request tells the server about a file, either
+// its full contents or the updates since the last acknowledged version.
+type filesyncUpload struct {
+	path     string
+	relPath  string
+	contents string
+	version  int32
+	rely     bool
+	hash     string
+	updates  []*v1.FilesyncUpdateWithModelVersion
+}
+
+// prepare builds the upload for contents of path: a delta against the last
+// acknowledged version if there is one, the full contents otherwise.
+func (f *filesync) prepare(ws workspace, path, contents string) *filesyncUpload {
+	upload := &filesyncUpload{path: path, relPath: ws.relative(path), contents: contents}
+	if !f.enabled {
+		return upload
+	}
+
+	sum := sha256.Sum256([]byte(contents))
+	upload.hash = hex.EncodeToString(sum[:])
+	upload.version = 1
+
+	f.mu.Lock()
+	base, ok := f.files[path]
+	f.mu.Unlock()
+
+	if !ok {
+		return upload
+	}
+
+	upload.version = base.version + 1
+	upload.rely = true
+
+	if base.contents != contents {
+		upload.updates = []*v1.FilesyncUpdateWithModelVersion{{
+			ModelVersion:          upload.version,
+			RelativeWorkspacePath: upload.relPath,
+			Updates:               []*v1.SingleUpdateRequest{singleUpdate(base.contents, contents)},
+			ExpectedFileLength:    int32(utf16Len(contents)),
+		}}
+	} else {
+		upload.version = base.version
+	}
+
+	return upload
+}
+
+// full is the fallback for an upload the server couldn't apply: the base is
+// dropped and the whole file is sent again.
+func (f *filesync) full(upload *filesyncUpload) *filesyncUpload {
+	f.forget(upload.path)
+
+	full := *upload
+	full.version, full.rely, full.updates = 1, false, nil
+
+	return &full
+}
+
+// ack records upload as the server's copy of its file once a request
+// carrying it went through.
+func (f *filesync) ack(upload *filesyncUpload) {
+	if !f.enabled {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.clock++
+	f.files[upload.path] = &syncedFile{
+		version:  upload.version,
+		contents: upload.contents,
+		used:     f.clock,
+	}
+
+	for len(f.files) > maxFilesyncFiles {
+		var oldest string
+		for path, file := range f.files {
+			if oldest == "" || file.used < f.files[oldest].used {
+				oldest = path
+			}
+		}
+		delete(f.files, oldest)
+	}
+}
+
+func (f *filesync) forget(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.files, path)
+}
+
+// currentFile sets the filesync fields of file, leaving out the contents
+// when the server can rebuild them.
+func (u *filesyncUpload) currentFile(file *v1.CurrentFileInfo) {
+	if u.hash == "" {
+		return
+	}
+
+	file.Sha_256Hash = &u.hash
+	file.RelyOnFilesync = u.rely
+	if u.rely {
+		file.Contents = ""
+	}
+}
+
+// openSynced opens a stream with upload, and if the server rejects an
+// upload that relies on filesync, say because its copy doesn't hash to
+// what we expect, retries once with the full contents.
+func openSynced[Res any](
+	f *filesync,
+	upload *filesyncUpload,
+	open func(upload *filesyncUpload) (*connect.ServerStreamForClient[Res], bool, error),
+) (*connect.ServerStreamForClient[Res], bool, *filesyncUpload, error) {
+	stream, ok, err := open(upload)
+	if err == nil || !upload.rely {
+		return stream, ok, upload, err
+	}
+
+	switch connect.CodeOf(err) {
+	case connect.CodeUnauthenticated, connect.CodeCanceled, connect.CodeDeadlineExceeded, connect.CodeUnavailable:
+		return stream, ok, upload, err
+	}
+
+	log.Printf("filesync upload of %s rejected, resending full contents: %v", upload.path, err)
+
+	upload = f.full(upload)
+	stream, ok, err = open(upload)
+
+	return stream, ok, upload, err
+}
+
+// singleUpdate describes the edit from old to new as the one replacement
+// between their common prefix and suffix. Offsets and lengths are in UTF-16
+// code units and the range is 1 based, as the server expects.
+func singleUpdate(old, new string) *v1.SingleUpdateRequest {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+
+	// keep both cuts on rune boundaries
+	for prefix > 0 && !isRuneStart(old, prefix) {
+		prefix--
+	}
+	for suffix > 0 && !isRuneStart(old, len(old)-suffix) {
+		suffix--
+	}
+
+	replaced := new[prefix : len(new)-suffix]
+	start := utf16Len(old[:prefix])
+	end := start + utf16Len(old[prefix:len(old)-suffix])
+
+	startLine, startCol := lineColumn(old, prefix)
+	endLine, endCol := lineColumn(old, len(old)-suffix)
+
+	return &v1.SingleUpdateRequest{
+		StartPosition:  int32(start),
+		EndPosition:    int32(end),
+		ChangeLength:   int32(utf16Len(replaced)),
+		ReplacedString: replaced,
+		Range: &v1.SimpleRange{
+			StartLineNumber:        int32(startLine),
+			StartColumn:            int32(startCol),
+			EndLineNumberInclusive: int32(endLine),
+			EndColumn:              int32(endCol),
+		},
+	}
+}
+
+func isRuneStart(s string, i int) bool {
+	return i >= len(s) || s[i]&0xC0 != 0x80
+}
+
+// lineColumn returns the 1 based line and UTF-16 column of byte offset i.
+func lineColumn(s string, i int) (int, int) {
+	before := s[:i]
+	line := strings.Count(before, "\n") + 1
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+
+	return line, utf16Len(before[lineStart:]) + 1
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
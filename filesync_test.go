@@ -0,0 +1,427 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	"connectrpc/cursor/gen/v1/aiserverv1connect"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"unicode/utf16"
+
+	"connectrpc.com/connect"
+)
+
+// applyUpdate applies u to s the way the server does, in UTF-16 code units.
+func applyUpdate(s string, u *v1.SingleUpdateRequest) (string, error) {
+	units := utf16.Encode([]rune(s))
+	start, end := int(u.StartPosition), int(u.EndPosition)
+	if start < 0 || start > end || end > len(units) {
+		return "", fmt.Errorf("update %d..%d out of range of %d units", start, end, len(units))
+	}
+
+	replaced := utf16.Encode([]rune(u.ReplacedString))
+	if len(replaced) != int(u.ChangeLength) {
+		return "", fmt.Errorf("change length %d, replaced string has %d units", u.ChangeLength, len(replaced))
+	}
+
+	out := append(append(append([]uint16(nil), units[:start]...), replaced...), units[end:]...)
+
+	return string(utf16.Decode(out)), nil
+}
+
+func TestSingleUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		old, new  string
+		start     int32
+		end       int32
+		replaced  string
+		wantRange *v1.SimpleRange
+	}{
+		{
+			name: "insert", old: "hello world", new: "hello, world",
+			start: 5, end: 5, replaced: ",",
+			wantRange: &v1.SimpleRange{StartLineNumber: 1, StartColumn: 6, EndLineNumberInclusive: 1, EndColumn: 6},
+		},
+		{
+			name: "delete on a later line", old: "a\nbcd\n", new: "a\nbd\n",
+			start: 3, end: 4, replaced: "",
+			wantRange: &v1.SimpleRange{StartLineNumber: 2, StartColumn: 2, EndLineNumberInclusive: 2, EndColumn: 3},
+		},
+		{
+			name: "after two byte runes", old: "héllo x", new: "héllo yx",
+			start: 6, end: 6, replaced: "y",
+			wantRange: &v1.SimpleRange{StartLineNumber: 1, StartColumn: 7, EndLineNumberInclusive: 1, EndColumn: 7},
+		},
+		{
+			name: "after surrogate pairs", old: "😀😀 = 1\n😀 = 2", new: "😀😀 = 1\n😀 = 3",
+			start: 14, end: 15, replaced: "3",
+			wantRange: &v1.SimpleRange{StartLineNumber: 2, StartColumn: 6, EndLineNumberInclusive: 2, EndColumn: 7},
+		},
+		{
+			name: "runes sharing leading bytes", old: "a é b", new: "a è b",
+			start: 2, end: 3, replaced: "è",
+			wantRange: &v1.SimpleRange{StartLineNumber: 1, StartColumn: 3, EndLineNumberInclusive: 1, EndColumn: 4},
+		},
+		{
+			name: "replace an emoji with cjk", old: "x😀y", new: "x漢字y",
+			start: 1, end: 3, replaced: "漢字",
+			wantRange: &v1.SimpleRange{StartLineNumber: 1, StartColumn: 2, EndLineNumberInclusive: 1, EndColumn: 4},
+		},
+		{
+			name: "across lines", old: "one\ntwo\nthree", new: "one\n2\nthree",
+			start: 4, end: 7, replaced: "2",
+			wantRange: &v1.SimpleRange{StartLineNumber: 2, StartColumn: 1, EndLineNumberInclusive: 2, EndColumn: 4},
+		},
+		{
+			name: "from empty", old: "", new: "ñ\n",
+			start: 0, end: 0, replaced: "ñ\n",
+			wantRange: &v1.SimpleRange{StartLineNumber: 1, StartColumn: 1, EndLineNumberInclusive: 1, EndColumn: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := singleUpdate(tt.old, tt.new)
+
+			if u.StartPosition != tt.start || u.EndPosition != tt.end || u.ReplacedString != tt.replaced {
+				t.Errorf("singleUpdate() = %d..%d %q, want %d..%d %q", u.StartPosition, u.EndPosition, u.ReplacedString, tt.start, tt.end, tt.replaced)
+			}
+			if u.Range.String() != tt.wantRange.String() {
+				t.Errorf("range = %v, want %v", u.Range, tt.wantRange)
+			}
+
+			got, err := applyUpdate(tt.old, u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.new {
+				t.Errorf("applying the update gives %q, want %q", got, tt.new)
+			}
+		})
+	}
+}
+
+type fakeSyncedFile struct {
+	version  int32
+	contents string
+}
+
+// fakeAiService keeps the files it was sent and rebuilds them from
+// filesync updates, rejecting requests it can't rebuild the way the real
+// server does.
+type fakeAiService struct {
+	aiserverv1connect.UnimplementedAiServiceHandler
+
+	mu       sync.Mutex
+	files    map[string]*fakeSyncedFile
+	requests []*v1.StreamCppRequest
+	reject   error
+}
+
+func (f *fakeAiService) StreamCpp(_ context.Context, req *connect.Request[v1.StreamCppRequest], stream *connect.ServerStream[v1.StreamCppResponse]) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, req.Msg)
+
+	if f.reject != nil {
+		return f.reject
+	}
+
+	file := req.Msg.CurrentFile
+	path := file.RelativeWorkspacePath
+
+	contents := file.Contents
+	version := int32(1)
+
+	if file.RelyOnFilesync {
+		base, ok := f.files[path]
+		if !ok {
+			return connect.NewError(connect.CodeFailedPrecondition, errors.New("unknown file"))
+		}
+
+		contents, version = base.contents, base.version
+		for _, update := range req.Msg.FilesyncUpdates {
+			if update.ModelVersion != version+1 {
+				return connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("version %d after %d", update.ModelVersion, version))
+			}
+
+			for _, u := range update.Updates {
+				var err error
+				if contents, err = applyUpdate(contents, u); err != nil {
+					return connect.NewError(connect.CodeFailedPrecondition, err)
+				}
+			}
+
+			if n := len(utf16.Encode([]rune(contents))); n != int(update.ExpectedFileLength) {
+				return connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("length %d, expected %d", n, update.ExpectedFileLength))
+			}
+			version = update.ModelVersion
+		}
+	}
+
+	if file.Sha_256Hash != nil {
+		sum := sha256.Sum256([]byte(contents))
+		if hex.EncodeToString(sum[:]) != *file.Sha_256Hash {
+			return connect.NewError(connect.CodeFailedPrecondition, errors.New("hash mismatch"))
+		}
+	}
+
+	f.files[path] = &fakeSyncedFile{version: version, contents: contents}
+
+	return stream.Send(&v1.StreamCppResponse{Text: contents})
+}
+
+func (f *fakeAiService) file(path string) *fakeSyncedFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.files[path]
+}
+
+func (f *fakeAiService) lastRequest() *v1.StreamCppRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests[len(f.requests)-1]
+}
+
+func newFakeAiService(t *testing.T) (*fakeAiService, aiserverv1connect.AiServiceClient) {
+	svc := &fakeAiService{files: map[string]*fakeSyncedFile{}}
+
+	mux := http.NewServeMux()
+	mux.Handle(aiserverv1connect.NewAiServiceHandler(svc))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return svc, aiserverv1connect.NewAiServiceClient(server.Client(), server.URL)
+}
+
+// syncFile sends contents the way crunchCppStream does and returns what the
+// server answered with, which the fake sets to its copy of the file.
+func syncFile(t *testing.T, f *filesync, client aiserverv1connect.AiServiceClient, path, contents string) (*filesyncUpload, int, error) {
+	t.Helper()
+
+	ws := workspace{Root: "/ws"}
+	opened := 0
+
+	stream, ok, upload, err := openSynced(f, f.prepare(ws, path, contents), func(upload *filesyncUpload) (*connect.ServerStreamForClient[v1.StreamCppResponse], bool, error) {
+		opened++
+
+		currentFile := &v1.CurrentFileInfo{RelativeWorkspacePath: upload.relPath, Contents: contents}
+		upload.currentFile(currentFile)
+
+		req := &v1.StreamCppRequest{CurrentFile: currentFile, FilesyncUpdates: upload.updates}
+
+		stream, err := client.StreamCpp(context.Background(), connect.NewRequest(req))
+		if err != nil {
+			return nil, false, err
+		}
+		if stream.Receive() {
+			return stream, true, nil
+		}
+		err = stream.Err()
+		stream.Close()
+
+		return nil, false, err
+	})
+	if err != nil {
+		return nil, opened, err
+	}
+	defer stream.Close()
+
+	if !ok || stream.Msg().Text != contents {
+		t.Fatalf("server rebuilt %q, want %q", stream.Msg().Text, contents)
+	}
+
+	f.ack(upload)
+
+	return upload, opened, nil
+}
+
+func TestFilesyncRebuildsFromDeltas(t *testing.T) {
+	svc, client := newFakeAiService(t)
+	f := newFilesync(true)
+
+	edits := []struct {
+		contents    string
+		wantVersion int32
+		wantRely    bool
+		wantUpdates int
+	}{
+		{contents: "package main\n", wantVersion: 1},
+		{contents: "package main\n\nfunc main() {}\n", wantVersion: 2, wantRely: true, wantUpdates: 1},
+		{contents: "package main\n\n// héllo 😀\nfunc main() {}\n", wantVersion: 3, wantRely: true, wantUpdates: 1},
+		{contents: "package main\n\n// héllo 😀\nfunc main() {}\n", wantVersion: 3, wantRely: true},
+		{contents: "package main\n\n// hello 😀😀\nfunc main() { println(\"漢字\") }\n", wantVersion: 4, wantRely: true, wantUpdates: 1},
+	}
+
+	for i, edit := range edits {
+		upload, opened, err := syncFile(t, f, client, "/ws/main.go", edit.contents)
+		if err != nil {
+			t.Fatalf("edit %d: %v", i, err)
+		}
+		if opened != 1 {
+			t.Errorf("edit %d: opened %d streams, want 1", i, opened)
+		}
+
+		if upload.version != edit.wantVersion || upload.rely != edit.wantRely || len(upload.updates) != edit.wantUpdates {
+			t.Errorf("edit %d: upload version %d rely %v updates %d, want %d %v %d", i, upload.version, upload.rely, len(upload.updates), edit.wantVersion, edit.wantRely, edit.wantUpdates)
+		}
+
+		req := svc.lastRequest()
+		if edit.wantRely && req.CurrentFile.Contents != "" {
+			t.Errorf("edit %d: sent contents while relying on filesync", i)
+		}
+		if req.CurrentFile.RelativeWorkspacePath != "main.go" {
+			t.Errorf("edit %d: relative path %q", i, req.CurrentFile.RelativeWorkspacePath)
+		}
+
+		if got := svc.file("main.go"); got.version != edit.wantVersion || got.contents != edit.contents {
+			t.Errorf("edit %d: server has version %d %q", i, got.version, got.contents)
+		}
+	}
+}
+
+func TestOpenSyncedFallsBackToFullContents(t *testing.T) {
+	svc, client := newFakeAiService(t)
+	f := newFilesync(true)
+
+	if _, _, err := syncFile(t, f, client, "/ws/a.txt", "one\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := syncFile(t, f, client, "/ws/a.txt", "one\ntwo\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server lost its copy, say after a restart
+	svc.mu.Lock()
+	delete(svc.files, "a.txt")
+	svc.mu.Unlock()
+
+	upload, opened, err := syncFile(t, f, client, "/ws/a.txt", "one\ntwo\nthree\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != 2 {
+		t.Errorf("opened %d streams, want 2", opened)
+	}
+	if upload.version != 1 || upload.rely || upload.updates != nil {
+		t.Errorf("fallback upload version %d rely %v updates %v, want a full upload", upload.version, upload.rely, upload.updates)
+	}
+	if got := svc.lastRequest().CurrentFile.Contents; got != "one\ntwo\nthree\n" {
+		t.Errorf("fallback sent contents %q", got)
+	}
+
+	// and deltas work again against the new base
+	upload, opened, err = syncFile(t, f, client, "/ws/a.txt", "one\ntwo\nthree\nfour\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != 1 || upload.version != 2 || !upload.rely {
+		t.Errorf("after fallback: opened %d, version %d, rely %v", opened, upload.version, upload.rely)
+	}
+}
+
+func TestOpenSyncedFallsBackOnHashMismatch(t *testing.T) {
+	svc, client := newFakeAiService(t)
+	f := newFilesync(true)
+
+	if _, _, err := syncFile(t, f, client, "/ws/a.txt", "abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server's copy drifted from ours
+	svc.mu.Lock()
+	svc.files["a.txt"].contents = "abX"
+	svc.mu.Unlock()
+
+	_, opened, err := syncFile(t, f, client, "/ws/a.txt", "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != 2 {
+		t.Errorf("opened %d streams, want 2", opened)
+	}
+	if got := svc.file("a.txt").contents; got != "abcd" {
+		t.Errorf("server has %q, want abcd", got)
+	}
+}
+
+func TestOpenSyncedDoesNotRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		reject error
+		rely   bool
+	}{
+		{name: "unauthenticated", reject: connect.NewError(connect.CodeUnauthenticated, errors.New("no")), rely: true},
+		{name: "unavailable", reject: connect.NewError(connect.CodeUnavailable, errors.New("down")), rely: true},
+		{name: "full upload", reject: connect.NewError(connect.CodeFailedPrecondition, errors.New("no")), rely: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, client := newFakeAiService(t)
+			f := newFilesync(true)
+
+			if tt.rely {
+				if _, _, err := syncFile(t, f, client, "/ws/a.txt", "a"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			svc.mu.Lock()
+			svc.reject = tt.reject
+			svc.mu.Unlock()
+
+			_, opened, err := syncFile(t, f, client, "/ws/a.txt", "ab")
+			if connect.CodeOf(err) != connect.CodeOf(tt.reject) {
+				t.Errorf("error = %v, want %v", err, tt.reject)
+			}
+			if opened != 1 {
+				t.Errorf("opened %d streams, want 1", opened)
+			}
+		})
+	}
+}
+
+func TestFilesyncDisabled(t *testing.T) {
+	f := newFilesync(false)
+
+	upload := f.prepare(workspace{Root: "/ws"}, "/ws/a.txt", "abc")
+	f.ack(upload)
+	upload = f.prepare(workspace{Root: "/ws"}, "/ws/a.txt", "abcd")
+
+	if upload.hash != "" || upload.rely || upload.updates != nil {
+		t.Errorf("disabled filesync prepared %+v", upload)
+	}
+
+	file := &v1.CurrentFileInfo{Contents: "abcd"}
+	upload.currentFile(file)
+	if file.Contents != "abcd" || file.Sha_256Hash != nil || file.RelyOnFilesync {
+		t.Errorf("disabled filesync changed the current file: %v", file)
+	}
+}
+
+func TestFilesyncEvictsLeastRecentlyUsed(t *testing.T) {
+	f := newFilesync(true)
+	ws := workspace{Root: "/ws"}
+
+	for i := range maxFilesyncFiles + 1 {
+		f.ack(f.prepare(ws, fmt.Sprintf("/ws/%d", i), "x"))
+	}
+
+	if upload := f.prepare(ws, "/ws/0", "y"); upload.rely {
+		t.Errorf("least recently used file wasn't evicted")
+	}
+	if upload := f.prepare(ws, fmt.Sprintf("/ws/%d", maxFilesyncFiles), "y"); !upload.rely {
+		t.Errorf("most recently used file was evicted")
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+const (
+	// lspSymbolRadius is how many lines around the cursor identifiers are
+	// collected from.
+	lspSymbolRadius = 5
+
+	// maxLspSymbols caps how many identifiers are looked up per request.
+	maxLspSymbols = 8
+
+	// maxDefinitionLines caps how much of a definition is sent as context.
+	maxDefinitionLines = 10
+
+	// lspCacheTTL is how long a looked up symbol is reused before asking
+	// the language server again.
+	lspCacheTTL = 30 * time.Second
+
+	// lspLateAnswer is how long an answer that missed the budget is still
+	// waited for, so it can be cached for the next request.
+	lspLateAnswer = 5 * time.Second
+)
+
+// lspContextLua asks the attached LSP clients for hover text and
+// definitions of the given symbols without blocking the editor, then
+// reports back with an rpcnotify to cursortab_lsp_context. A method no
+// client supports isn't requested at all, so it can't hold up the answer.
+const lspContextLua = `
+local chan, id, bufnr, symbols = ...
+local hover_client = vim.lsp.get_clients({ bufnr = bufnr, method = "textDocument/hover" })[1]
+local def_client = vim.lsp.get_clients({ bufnr = bufnr, method = "textDocument/definition" })[1]
+local requests = (hover_client and 1 or 0) + (def_client and 1 or 0)
+if requests == 0 or #symbols == 0 then
+	vim.rpcnotify(chan, "cursortab_lsp_context", id, {})
+	return
+end
+
+-- read_lines prefers a loaded buffer but never creates one, and gives up
+-- quietly on files it can't open
+local function read_lines(uri, first, count)
+	local ok, fname = pcall(vim.uri_to_fname, uri)
+	if not ok then
+		return {}
+	end
+	for _, buf in ipairs(vim.api.nvim_list_bufs()) do
+		if vim.api.nvim_buf_is_loaded(buf) and vim.api.nvim_buf_get_name(buf) == fname then
+			return vim.api.nvim_buf_get_lines(buf, first, first + count, false)
+		end
+	end
+	local f = io.open(fname, "r")
+	if not f then
+		return {}
+	end
+	local lines, i = {}, 0
+	for line in f:lines() do
+		if i >= first + count then
+			break
+		end
+		if i >= first then
+			table.insert(lines, line)
+		end
+		i = i + 1
+	end
+	f:close()
+	return lines
+end
+
+local results = {}
+local pending = #symbols * requests
+local function done()
+	pending = pending - 1
+	if pending == 0 then
+		vim.rpcnotify(chan, "cursortab_lsp_context", id, results)
+	end
+end
+
+-- handle runs a response handler, counting it done even if it throws so
+-- the answer still goes out
+local function handle(f)
+	return function(responses)
+		pcall(f, responses)
+		done()
+	end
+end
+
+local function params(client, sym)
+	return {
+		textDocument = vim.lsp.util.make_text_document_params(bufnr),
+		position = {
+			line = sym.line,
+			character = vim.lsp.util.character_offset(bufnr, sym.line, sym.col, client.offset_encoding),
+		},
+	}
+end
+
+for i, sym in ipairs(symbols) do
+	local result = { name = sym.name, line = sym.line, col = sym.col, hover = "", defs = {} }
+	results[i] = result
+
+	if hover_client then
+		vim.lsp.buf_request_all(bufnr, "textDocument/hover", params(hover_client, sym), handle(function(responses)
+			for _, resp in pairs(responses) do
+				local res = resp.result
+				if res and res.contents and result.hover == "" then
+					local lines = vim.lsp.util.convert_input_to_markdown_lines(res.contents)
+					result.hover = table.concat(lines, "\n")
+				end
+			end
+		end))
+	end
+
+	if def_client then
+		vim.lsp.buf_request_all(bufnr, "textDocument/definition", params(def_client, sym), handle(function(responses)
+			for _, resp in pairs(responses) do
+				local res = resp.result
+				if res then
+					if res.uri or res.targetUri then res = { res } end
+					for _, loc in ipairs(res) do
+						local uri = loc.uri or loc.targetUri
+						local range = loc.range or loc.targetSelectionRange or loc.targetRange
+						table.insert(result.defs, {
+							uri = uri,
+							start_line = range.start.line,
+							start_char = range.start.character,
+							end_line = range["end"].line,
+							end_char = range["end"].character,
+							content = table.concat(read_lines(uri, range.start.line, sym.max_lines), "\n"),
+						})
+					end
+				end
+			end
+		end))
+	end
+end
+`
+
+type lspSymbol struct {
+	Name     string `msgpack:"name"`
+	Line     int    `msgpack:"line"`
+	Col      int    `msgpack:"col"`
+	MaxLines int    `msgpack:"max_lines"`
+	distance int
+}
+
+type lspSymbolResult struct {
+	Name  string          `msgpack:"name"`
+	Line  int             `msgpack:"line"`
+	Col   int             `msgpack:"col"`
+	Hover string          `msgpack:"hover"`
+	Defs  []lspDefinition `msgpack:"defs"`
+}
+
+type lspDefinition struct {
+	URI       string `msgpack:"uri"`
+	StartLine int    `msgpack:"start_line"`
+	StartChar int    `msgpack:"start_char"`
+	EndLine   int    `msgpack:"end_line"`
+	EndChar   int    `msgpack:"end_char"`
+	Content   string `msgpack:"content"`
+}
+
+// luaWaiters hands out ids for asynchronous Lua calls and routes the
+// rpcnotify that answers each one back to its caller.
+type luaWaiters[T any] struct {
+	mu      sync.Mutex
+	next    int
+	waiting map[int]chan T
+}
+
+func newLuaWaiters[T any]() *luaWaiters[T] {
+	return &luaWaiters[T]{waiting: map[int]chan T{}}
+}
+
+func (w *luaWaiters[T]) add() (int, chan T) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.next++
+	ch := make(chan T, 1)
+	w.waiting[w.next] = ch
+
+	return w.next, ch
+}
+
+func (w *luaWaiters[T]) resolve(id int, v T) {
+	w.mu.Lock()
+	ch, ok := w.waiting[id]
+	delete(w.waiting, id)
+	w.mu.Unlock()
+
+	if ok {
+		ch <- v
+	}
+}
+
+func (w *luaWaiters[T]) remove(id int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.waiting, id)
+}
+
+// wait runs the Lua call through start and waits up to budget for its
+// answer. ok is false if the budget ran out first.
+func (w *luaWaiters[T]) wait(budget time.Duration, start func(id int) error) (v T, ok bool, err error) {
+	id, ch := w.add()
+	defer w.remove(id)
+
+	if err := start(id); err != nil {
+		return v, false, err
+	}
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+
+	select {
+	case v = <-ch:
+		return v, true, nil
+	case <-timer.C:
+		return v, false, nil
+	}
+}
+
+type lspCacheEntry struct {
+	result lspSymbolResult
+	at     time.Time
+}
+
+// lspContext collects LSP hover text and definitions for identifiers near
+// the cursor, caching them per file and symbol.
+type lspContext struct {
+	waiters *luaWaiters[[]lspSymbolResult]
+
+	mu    sync.Mutex
+	cache map[string]lspCacheEntry
+}
+
+func newLspContext() *lspContext {
+	return &lspContext{
+		waiters: newLuaWaiters[[]lspSymbolResult](),
+		cache:   map[string]lspCacheEntry{},
+	}
+}
+
+func (l *lspContext) register(v *nvim.Nvim) error {
+	return v.RegisterHandler("cursortab_lsp_context", func(id int, results []lspSymbolResult) {
+		l.waiters.resolve(id, results)
+	})
+}
+
+var identifierRe = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// lspIgnoredWords are keywords common enough across languages that looking
+// them up is a waste of the budget.
+var lspIgnoredWords = map[string]bool{
+	"if": true, "else": true, "for": true, "while": true, "return": true,
+	"func": true, "function": true, "local": true, "end": true, "then": true,
+	"nil": true, "null": true, "true": true, "false": true, "const": true,
+	"var": true, "let": true, "def": true, "class": true, "import": true,
+	"from": true, "package": true, "struct": true, "type": true, "self": true,
+	"this": true, "new": true, "None": true, "True": true, "False": true,
+}
+
+// symbolsNearCursor returns the distinct identifiers within lspSymbolRadius
+// lines of the cursor, closest first. line and col are 0 based.
+func symbolsNearCursor(lines []string, line, col int) []lspSymbol {
+	seen := map[string]bool{}
+	var symbols []lspSymbol
+
+	for i := max(0, line-lspSymbolRadius); i <= min(len(lines)-1, line+lspSymbolRadius); i++ {
+		for _, loc := range identifierRe.FindAllStringIndex(lines[i], -1) {
+			name := lines[i][loc[0]:loc[1]]
+			if len(name) < 3 || lspIgnoredWords[name] || seen[name] {
+				continue
+			}
+
+			// skip the word being typed, it has no definition yet
+			if i == line && loc[0] <= col && col <= loc[1] {
+				continue
+			}
+
+			seen[name] = true
+
+			distance := abs(i-line) * 1000
+			if i == line {
+				distance += abs(loc[0] - col)
+			}
+
+			symbols = append(symbols, lspSymbol{
+				Name:     name,
+				Line:     i,
+				Col:      loc[0],
+				MaxLines: maxDefinitionLines,
+				distance: distance,
+			})
+		}
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return symbols[i].distance < symbols[j].distance
+	})
+
+	if len(symbols) > maxLspSymbols {
+		symbols = symbols[:maxLspSymbols]
+	}
+
+	return symbols
+}
+
+// collect looks up the symbols around the cursor of b, spending at most
+// budget waiting on language servers. Symbols that don't answer in time
+// are left out rather than delaying the completion.
+func (l *lspContext) collect(v *nvim.Nvim, b *buffer, ws workspace, budget time.Duration) ([]*v1.LspSubgraphFullContext, []*v1.CppContextItem) {
+	if budget <= 0 {
+		return nil, nil
+	}
+
+	symbols := symbolsNearCursor(b.lines, b.col, b.row)
+
+	now := time.Now()
+	var results []lspSymbolResult
+	var missing []lspSymbol
+
+	l.mu.Lock()
+	for _, sym := range symbols {
+		if entry, ok := l.cache[b.path+"\x00"+sym.Name]; ok && now.Sub(entry.at) < lspCacheTTL {
+			result := entry.result
+			result.Line, result.Col = sym.Line, sym.Col
+			results = append(results, result)
+		} else {
+			missing = append(missing, sym)
+		}
+	}
+	l.mu.Unlock()
+
+	if len(missing) > 0 {
+		results = append(results, l.fetch(v, b, missing, budget)...)
+	}
+
+	return lspContexts(ws, b.path, b.col, results)
+}
+
+// fetch asks Neovim about symbols, waiting at most budget. Whatever comes
+// back is cached, including symbols the server knows nothing about. If the
+// budget runs out the symbols are cached as unknown and the answer is
+// still waited for in the background, so a slow server costs the budget
+// once per lspCacheTTL rather than on every request.
+func (l *lspContext) fetch(v *nvim.Nvim, b *buffer, symbols []lspSymbol, budget time.Duration) []lspSymbolResult {
+	id, ch := l.waiters.add()
+
+	if err := v.ExecLua(lspContextLua, nil, v.ChannelID(), id, b.id, symbols); err != nil {
+		l.waiters.remove(id)
+		log.Printf("error requesting lsp context: %v", err)
+		return nil
+	}
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+
+	select {
+	case fetched := <-ch:
+		l.store(b.path, fetched)
+		return fetched
+
+	case <-timer.C:
+		log.Printf("lsp context exceeded budget of %v", budget)
+
+		unknown := make([]lspSymbolResult, len(symbols))
+		for i, sym := range symbols {
+			unknown[i] = lspSymbolResult{Name: sym.Name, Line: sym.Line, Col: sym.Col}
+		}
+		l.store(b.path, unknown)
+
+		go func() {
+			late := time.NewTimer(lspLateAnswer)
+			defer late.Stop()
+
+			select {
+			case fetched := <-ch:
+				l.store(b.path, fetched)
+			case <-late.C:
+				l.waiters.remove(id)
+			}
+		}()
+
+		return nil
+	}
+}
+
+func (l *lspContext) store(path string, results []lspSymbolResult) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, result := range results {
+		l.cache[path+"\x00"+result.Name] = lspCacheEntry{result: result, at: now}
+	}
+	l.evictLocked(now)
+}
+
+func (l *lspContext) evictLocked(now time.Time) {
+	for key, entry := range l.cache {
+		if now.Sub(entry.at) >= lspCacheTTL {
+			delete(l.cache, key)
+		}
+	}
+}
+
+// lspContexts converts symbol lookups into the request's LspContexts and
+// ContextItems, scoring symbols closer to the cursor line higher.
+func lspContexts(ws workspace, path string, line int, results []lspSymbolResult) ([]*v1.LspSubgraphFullContext, []*v1.CppContextItem) {
+	var contexts []*v1.LspSubgraphFullContext
+	var items []*v1.CppContextItem
+
+	uri := fileURI(path)
+
+	for _, result := range results {
+		if result.Hover == "" && len(result.Defs) == 0 {
+			continue
+		}
+
+		score := 1 / float32(1+abs(result.Line-line))
+		name := result.Name
+
+		context := &v1.LspSubgraphFullContext{
+			Uri:        uri,
+			SymbolName: result.Name,
+			Positions: []*v1.LspSubgraphPosition{
+				{Line: int32(result.Line), Character: int32(result.Col)},
+			},
+			Score: score,
+		}
+
+		if result.Hover != "" {
+			context.ContextItems = append(context.ContextItems, &v1.LspSubgraphContextItem{
+				Type:    "hover",
+				Content: result.Hover,
+			})
+
+			items = append(items, &v1.CppContextItem{
+				Contents:              result.Hover,
+				Symbol:                &name,
+				RelativeWorkspacePath: ws.relative(path),
+				Score:                 score,
+			})
+		}
+
+		for _, def := range result.Defs {
+			defURI := def.URI
+			context.ContextItems = append(context.ContextItems, &v1.LspSubgraphContextItem{
+				Uri:     &defURI,
+				Type:    "definition",
+				Content: def.Content,
+				Range: &v1.LspSubgraphRange{
+					StartLine:      int32(def.StartLine),
+					StartCharacter: int32(def.StartChar),
+					EndLine:        int32(def.EndLine),
+					EndCharacter:   int32(def.EndChar),
+				},
+			})
+
+			if def.Content != "" {
+				items = append(items, &v1.CppContextItem{
+					Contents:              def.Content,
+					Symbol:                &name,
+					RelativeWorkspacePath: ws.relative(uriPath(def.URI)),
+					Score:                 score,
+				})
+			}
+		}
+
+		contexts = append(contexts, context)
+	}
+
+	return contexts, items
+}
+
+func fileURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return strings.TrimPrefix(uri, "file://")
+	}
+
+	return u.Path
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
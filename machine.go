@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// machineIDFiles are read in order when Cursor hasn't stored a machine id.
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// machineIdentity identifies this machine to the backend the same way the
+// editor does.
+type machineIdentity struct {
+	machineID    string
+	macMachineID string
+}
+
+// newMachineIdentity prefers the ids Cursor itself stored and derives the
+// rest from the host so they stay stable across sessions.
+func newMachineIdentity(creds *cursorCredentials) *machineIdentity {
+	id := &machineIdentity{
+		machineID:    creds.machineID,
+		macMachineID: creds.macMachineID,
+	}
+
+	if id.machineID == "" {
+		id.machineID = hashID(hostMachineID())
+	}
+
+	if id.macMachineID == "" {
+		if mac := hardwareAddr(); mac != "" {
+			id.macMachineID = hashID(mac)
+		} else {
+			id.macMachineID = id.machineID
+		}
+	}
+
+	log.Printf("machine id: %s, mac machine id: %s", id.machineID, id.macMachineID)
+
+	return id
+}
+
+// checksum builds the x-cursor-checksum header for a request sent at now.
+func (m *machineIdentity) checksum(now time.Time) string {
+	timestamp := uint64(now.UnixMilli())
+
+	timestampBytes := []byte{
+		byte(timestamp >> 40),
+		byte(timestamp >> 32),
+		byte(timestamp >> 24),
+		byte(timestamp >> 16),
+		byte(timestamp >> 8),
+		byte(timestamp),
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(encryptBytes(timestampBytes))
+
+	if m.macMachineID == "" {
+		return encoded + m.machineID
+	}
+
+	return encoded + m.machineID + "/" + m.macMachineID
+}
+
+func encryptBytes(input []byte) []byte {
+	w := byte(165)
+	for i := 0; i < len(input); i++ {
+		input[i] = (input[i] ^ w) + byte(i%256)
+		w = input[i]
+	}
+	return input
+}
+
+func hostMachineID() string {
+	for _, path := range machineIDFiles {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		if id := strings.TrimSpace(string(raw)); id != "" {
+			return id
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("error getting hostname: %v", err)
+	}
+
+	return hostname
+}
+
+// virtualInterfacePrefixes name interfaces that come and go with
+// containers, VMs and VPNs.
+var virtualInterfacePrefixes = []string{
+	"docker", "veth", "br-", "virbr", "vmnet", "vboxnet", "tun", "tap",
+	"utun", "wg", "zt", "tailscale", "bridge", "awdl", "llw", "cni", "flannel",
+}
+
+// hardwareAddr returns the MAC address of the first physical interface by
+// name, if any.
+func hardwareAddr() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("error listing network interfaces: %v", err)
+		return ""
+	}
+
+	return pickHardwareAddr(ifaces)
+}
+
+// pickHardwareAddr skips loopback, down and virtual interfaces, as well as
+// locally administered addresses, which virtual interfaces make up, so the
+// pick doesn't change when a container or VPN starts.
+func pickHardwareAddr(ifaces []net.Interface) string {
+	var physical []net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if len(iface.HardwareAddr) == 0 || iface.HardwareAddr[0]&0x02 != 0 {
+			continue
+		}
+		if slices.ContainsFunc(virtualInterfacePrefixes, func(prefix string) bool {
+			return strings.HasPrefix(iface.Name, prefix)
+		}) {
+			continue
+		}
+
+		physical = append(physical, iface)
+	}
+
+	if len(physical) == 0 {
+		return ""
+	}
+
+	slices.SortFunc(physical, func(a, b net.Interface) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return physical[0].HardwareAddr.String()
+}
+
+func hashID(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// the vectors were computed independently of this package
+func TestEncryptBytes(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want []byte
+	}{
+		{
+			in:   []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			want: []byte{0xa5, 0xa6, 0xa8, 0xab, 0xaf, 0xb4},
+		},
+		{
+			in:   []byte{0x01, 0x8b, 0xcf, 0xe5, 0x68, 0x00},
+			want: []byte{0xa4, 0x30, 0x01, 0xe7, 0x93, 0x98},
+		},
+		{
+			in:   []byte{0x01, 0x90, 0x00, 0xc9, 0x7e, 0x40},
+			want: []byte{0xa4, 0x35, 0x37, 0x01, 0x83, 0xc8},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := encryptBytes(bytes.Clone(tt.in)); !bytes.Equal(got, tt.want) {
+			t.Errorf("encryptBytes(%x) = %x, want %x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		now  time.Time
+		id   machineIdentity
+		want string
+	}{
+		{
+			name: "epoch",
+			now:  time.UnixMilli(0),
+			id:   machineIdentity{machineID: "m", macMachineID: "mac"},
+			want: "paaoq6+0m/mac",
+		},
+		{
+			name: "timestamp",
+			now:  time.UnixMilli(1_700_000_000_000),
+			id:   machineIdentity{machineID: "m", macMachineID: "mac"},
+			want: "pDAB55OYm/mac",
+		},
+		{
+			name: "milliseconds count",
+			now:  time.UnixMilli(1_718_000_123_456),
+			id:   machineIdentity{machineID: "m", macMachineID: "mac"},
+			want: "pDU3AYPIm/mac",
+		},
+		{
+			name: "no mac machine id",
+			now:  time.UnixMilli(1_700_000_000_000),
+			id:   machineIdentity{machineID: "m"},
+			want: "pDAB55OYm",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.id.checksum(tt.now); got != tt.want {
+				t.Errorf("checksum() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickHardwareAddr(t *testing.T) {
+	mac := func(s string) net.HardwareAddr {
+		addr, err := net.ParseMAC(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	up := net.FlagUp | net.FlagBroadcast
+
+	eth := net.Interface{Name: "eth0", Flags: up, HardwareAddr: mac("00:11:22:33:44:55")}
+	wlan := net.Interface{Name: "wlan0", Flags: up, HardwareAddr: mac("00:aa:bb:cc:dd:ee")}
+
+	tests := []struct {
+		name   string
+		ifaces []net.Interface
+		want   string
+	}{
+		{
+			name:   "sorted by name",
+			ifaces: []net.Interface{wlan, eth},
+			want:   "00:11:22:33:44:55",
+		},
+		{
+			name: "skips loopback and down",
+			ifaces: []net.Interface{
+				{Name: "lo", Flags: up | net.FlagLoopback, HardwareAddr: mac("00:00:00:00:00:01")},
+				{Name: "eno1", Flags: net.FlagBroadcast, HardwareAddr: mac("00:01:02:03:04:05")},
+				wlan,
+			},
+			want: "00:aa:bb:cc:dd:ee",
+		},
+		{
+			name: "skips virtual interfaces",
+			ifaces: []net.Interface{
+				{Name: "br-1234", Flags: up, HardwareAddr: mac("00:01:02:03:04:05")},
+				{Name: "docker0", Flags: up, HardwareAddr: mac("00:01:02:03:04:06")},
+				{Name: "a-vpn", Flags: up, HardwareAddr: mac("02:42:ac:11:00:02")},
+				wlan,
+			},
+			want: "00:aa:bb:cc:dd:ee",
+		},
+		{
+			name: "skips interfaces without an address",
+			ifaces: []net.Interface{
+				{Name: "a0", Flags: up},
+				wlan,
+			},
+			want: "00:aa:bb:cc:dd:ee",
+		},
+		{
+			name:   "none",
+			ifaces: []net.Interface{{Name: "veth0", Flags: up, HardwareAddr: mac("00:01:02:03:04:05")}},
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickHardwareAddr(tt.ifaces); got != tt.want {
+				t.Errorf("pickHardwareAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
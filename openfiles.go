@@ -0,0 +1,125 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	"sort"
+)
+
+// openFilesLua lists every loaded, listed buffer with the lines visible in
+// each window showing it.
+const openFilesLua = `
+local out = {}
+for _, info in ipairs(vim.fn.getbufinfo({ buflisted = 1 })) do
+	if info.name ~= "" and info.loaded == 1 then
+		local ranges = {}
+		for _, win in ipairs(info.windows) do
+			local first = vim.fn.line("w0", win)
+			local last = vim.fn.line("w$", win)
+			table.insert(ranges, {
+				first = first,
+				last = last,
+				lines = vim.api.nvim_buf_get_lines(info.bufnr, first - 1, last, false),
+			})
+		end
+		table.insert(out, { name = info.name, lastused = info.lastused, ranges = ranges })
+	end
+end
+return out
+`
+
+type openBuffer struct {
+	Name     string         `msgpack:"name"`
+	LastUsed int64          `msgpack:"lastused"`
+	Ranges   []visibleRange `msgpack:"ranges"`
+}
+
+// visibleRange is a 1 based, inclusive range of lines shown in a window.
+type visibleRange struct {
+	First int      `msgpack:"first"`
+	Last  int      `msgpack:"last"`
+	Lines []string `msgpack:"lines"`
+}
+
+// openBuffers asks Neovim for the listed buffers, most recently used first.
+func (s *state) openBuffers() ([]openBuffer, error) {
+	var bufs []openBuffer
+	if err := s.v.ExecLua(openFilesLua, &bufs); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(bufs, func(i, j int) bool {
+		return bufs[i].LastUsed > bufs[j].LastUsed
+	})
+
+	return bufs, nil
+}
+
+// additionalFiles converts the open buffers other than current into
+// AdditionalFile entries, capped at maxFiles files and maxBytes of visible
+// content in total.
+func additionalFiles(bufs []openBuffer, current string, ws workspace, maxFiles, maxBytes int) []*v1.AdditionalFile {
+	var files []*v1.AdditionalFile
+	budget := maxBytes
+
+	for _, buf := range bufs {
+		if buf.Name == current {
+			continue
+		}
+		if len(files) >= maxFiles {
+			break
+		}
+
+		file := &v1.AdditionalFile{
+			RelativeWorkspacePath: ws.relative(buf.Name),
+			IsOpen:                true,
+		}
+
+		if buf.LastUsed > 0 {
+			lastViewedAt := float64(buf.LastUsed * 1000)
+			file.LastViewedAt = &lastViewedAt
+		}
+
+	ranges:
+		for _, r := range buf.Ranges {
+			for _, line := range r.Lines {
+				if len(line)+1 > budget {
+					budget = 0
+					break ranges
+				}
+				budget -= len(line) + 1
+				file.VisibleRangeContent = append(file.VisibleRangeContent, line)
+			}
+		}
+
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// fileVisibleRanges converts the windows of every open buffer into
+// FileVisibleRange entries for cursor prediction, capped at maxFiles files.
+func fileVisibleRanges(bufs []openBuffer, ws workspace, maxFiles int) []*v1.StreamNextCursorPredictionRequest_FileVisibleRange {
+	var out []*v1.StreamNextCursorPredictionRequest_FileVisibleRange
+
+	for _, buf := range bufs {
+		if len(buf.Ranges) == 0 {
+			continue
+		}
+		if len(out) >= maxFiles {
+			break
+		}
+
+		fileRange := &v1.StreamNextCursorPredictionRequest_FileVisibleRange{Filename: ws.relative(buf.Name)}
+		for _, r := range buf.Ranges {
+			fileRange.VisibleRanges = append(fileRange.VisibleRanges, &v1.StreamNextCursorPredictionRequest_FileVisibleRange_VisibleRange{
+				StartLineNumberInclusive: int32(r.First),
+				EndLineNumberExclusive:   int32(r.Last + 1),
+			})
+		}
+
+		out = append(out, fileRange)
+	}
+
+	return out
+}
@@ -40,3 +40,28 @@ vim.api.nvim_create_autocmd({ "TextChanged", "TextChangedI" }, {
 vim.keymap.set("i", "<Tab>", function()
 	vim.fn.rpcrequest(ensure_job(), "cursortab_tab_key", ns_id)
 end, { noremap = true, silent = true })
+
+-- map these to taste, e.g. vim.keymap.set("i", "<C-Right>", "<Plug>(cursortab-accept-word)")
+for name, method in pairs({
+	["cursortab-accept-word"] = "cursortab_accept_word",
+	["cursortab-accept-line"] = "cursortab_accept_line",
+	["cursortab-reject"] = "cursortab_reject",
+}) do
+	vim.keymap.set("i", "<Plug>(" .. name .. ")", function()
+		vim.fn.rpcrequest(ensure_job(), method, ns_id)
+	end, { noremap = true, silent = true })
+end
+
+-- keep the latest status around for statuslines, see :h User
+vim.api.nvim_create_autocmd("User", {
+	pattern = "CursorTabStatus",
+	callback = function(ev)
+		vim.g.cursortab_status = ev.data
+	end,
+})
+
+vim.api.nvim_create_user_command("CursorTabStatus", function()
+	local status = vim.fn.rpcrequest(ensure_job(), "cursortab_status")
+	vim.g.cursortab_status = status
+	print(vim.inspect(status))
+end, {})
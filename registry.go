@@ -0,0 +1,299 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// lineModel mirrors the lines of one buffer, kept up to date from
+// nvim_buf_lines_event deltas so we don't have to copy the whole buffer over
+// RPC on every trigger.
+type lineModel struct {
+	lines       []string
+	changedtick int64
+	valid       bool
+}
+
+// apply splices an on_lines delta into the model. It reports false if the
+// delta doesn't fit, in which case the model is invalidated and the next
+// sync does a full read.
+func (m *lineModel) apply(changedtick, firstLine, lastLine int64, data []string) bool {
+	if !m.valid {
+		return false
+	}
+
+	if lastLine == -1 {
+		lastLine = int64(len(m.lines))
+	}
+
+	if firstLine < 0 || firstLine > lastLine || lastLine > int64(len(m.lines)) {
+		m.valid = false
+		return false
+	}
+
+	lines := make([]string, 0, len(m.lines)-int(lastLine-firstLine)+len(data))
+	lines = append(lines, m.lines[:firstLine]...)
+	lines = append(lines, data...)
+	lines = append(lines, m.lines[lastLine:]...)
+
+	m.lines = lines
+	m.changedtick = changedtick
+
+	return true
+}
+
+func (m *lineModel) reset(lines []string, changedtick int64) {
+	m.lines = lines
+	m.changedtick = changedtick
+	m.valid = true
+}
+
+// bufferRegistry holds a buffer for every Neovim buffer we have synced,
+// each with its own line model, version and pending suggestion, and the
+// workspace roots found for them.
+type bufferRegistry struct {
+	mu      sync.Mutex
+	buffers map[nvim.Buffer]*buffer
+	roots   map[nvim.Buffer]workspaceRoot
+}
+
+// workspaceRoot is the root found for a buffer while it had path.
+type workspaceRoot struct {
+	path, root string
+}
+
+func newBufferRegistry() *bufferRegistry {
+	return &bufferRegistry{
+		buffers: map[nvim.Buffer]*buffer{},
+		roots:   map[nvim.Buffer]workspaceRoot{},
+	}
+}
+
+// workspaceRoot returns the root cached for id, "" if there is none or the
+// buffer has been renamed from the path it was found for.
+func (r *bufferRegistry) workspaceRoot(id nvim.Buffer, path string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cached, ok := r.roots[id]
+	if !ok || cached.path != path {
+		return ""
+	}
+
+	return cached.root
+}
+
+func (r *bufferRegistry) setWorkspaceRoot(id nvim.Buffer, path, root string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roots[id] = workspaceRoot{path: path, root: root}
+}
+
+// get returns the entry for id, creating it on first use.
+func (r *bufferRegistry) get(id nvim.Buffer) *buffer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.buffers[id]
+	if !ok {
+		b = newBuffer(id)
+		r.buffers[id] = b
+	}
+
+	return b
+}
+
+// others returns every buffer except id.
+func (r *bufferRegistry) others(id nvim.Buffer) []*buffer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	others := make([]*buffer, 0, len(r.buffers))
+	for bufID, b := range r.buffers {
+		if bufID != id {
+			others = append(others, b)
+		}
+	}
+
+	return others
+}
+
+// register subscribes to the buffer update notifications.
+func (r *bufferRegistry) register(v *nvim.Nvim) error {
+	if err := v.RegisterHandler(nvim.EventBufLines, r.onLines); err != nil {
+		return err
+	}
+
+	if err := v.RegisterHandler(nvim.EventBufChangedtick, r.onChangedtick); err != nil {
+		return err
+	}
+
+	return v.RegisterHandler(nvim.EventBufDetach, r.onDetach)
+}
+
+// lines returns the current lines of b and their changedtick, from its
+// model when the model's changedtick matches the buffer's and with a full
+// read otherwise.
+func (r *bufferRegistry) lines(v *nvim.Nvim, b *buffer) ([]string, int, error) {
+	r.mu.Lock()
+	attached := b.attached
+	r.mu.Unlock()
+
+	if !attached {
+		ok, err := v.AttachBuffer(b.id, false, map[string]any{})
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			r.mu.Lock()
+			b.attached = true
+			b.model = lineModel{}
+			r.mu.Unlock()
+		} else {
+			log.Printf("unable to attach to buffer %d, reading it in full", b.id)
+		}
+	}
+
+	changedtick, err := v.BufferChangedTick(b.id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r.mu.Lock()
+	if b.attached && b.model.valid && b.model.changedtick == int64(changedtick) {
+		lines := append([]string(nil), b.model.lines...)
+		r.mu.Unlock()
+		return lines, changedtick, nil
+	}
+	r.mu.Unlock()
+
+	log.Printf("buffer %d diverged from model (changedtick %d), resyncing", b.id, changedtick)
+
+	// read the lines and their changedtick atomically so a delta that lands
+	// in between can't be applied twice
+	var raw [][]byte
+	batch := v.NewBatch()
+	batch.BufferChangedTick(b.id, &changedtick)
+	batch.BufferLines(b.id, 0, -1, false, &raw)
+	if err := batch.Execute(); err != nil {
+		return nil, 0, err
+	}
+
+	lines := make([]string, len(raw))
+	for i, line := range raw {
+		lines[i] = string(line)
+	}
+
+	r.mu.Lock()
+	if b.attached {
+		b.model.reset(append([]string(nil), lines...), int64(changedtick))
+	}
+	r.mu.Unlock()
+
+	return lines, changedtick, nil
+}
+
+func (r *bufferRegistry) onLines(args ...any) {
+	if len(args) < 5 {
+		return
+	}
+
+	id, ok := args[0].(nvim.Buffer)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.buffers[id]
+	if !ok || !b.attached {
+		return
+	}
+	model := &b.model
+
+	// changedtick is nil when only the "more" continuation of an update is
+	// sent, which we treat the same as a divergence
+	changedtick, ok := toInt64(args[1])
+	firstLine, okFirst := toInt64(args[2])
+	lastLine, okLast := toInt64(args[3])
+	if !ok || !okFirst || !okLast {
+		model.valid = false
+		return
+	}
+
+	if changedtick <= model.changedtick {
+		// already reflected by a full resync
+		return
+	}
+
+	data, _ := args[4].([]any)
+	lines := make([]string, len(data))
+	for i, line := range data {
+		switch line := line.(type) {
+		case string:
+			lines[i] = line
+		case []byte:
+			lines[i] = string(line)
+		}
+	}
+
+	model.apply(changedtick, firstLine, lastLine, lines)
+}
+
+func (r *bufferRegistry) onChangedtick(args ...any) {
+	if len(args) < 2 {
+		return
+	}
+
+	id, ok := args[0].(nvim.Buffer)
+	if !ok {
+		return
+	}
+
+	changedtick, ok := toInt64(args[1])
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b, ok := r.buffers[id]; ok && b.attached && b.model.valid && changedtick > b.model.changedtick {
+		b.model.changedtick = changedtick
+	}
+}
+
+// onDetach forgets a buffer once Neovim unloads it.
+func (r *bufferRegistry) onDetach(args ...any) {
+	if len(args) < 1 {
+		return
+	}
+
+	id, ok := args[0].(nvim.Buffer)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.buffers, id)
+	delete(r.roots, id)
+}
+
+func toInt64(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// clock is the time source for the scheduler, swapped out for a fake one in
+// tests.
+type clock interface {
+	AfterFunc(d time.Duration, f func()) stoppable
+}
+
+type stoppable interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) AfterFunc(d time.Duration, f func()) stoppable {
+	return time.AfterFunc(d, f)
+}
+
+// schedulerStats counts what happened to sync triggers. dropped covers
+// both triggers superseded after their timer fired and fired ones that
+// never made a request.
+type schedulerStats struct {
+	triggers uint64
+	merged   uint64
+	dropped  uint64
+	fired    uint64
+}
+
+// scheduler coalesces bursts of sync triggers into a single request that is
+// issued once typing pauses for the debounce duration.
+type scheduler struct {
+	mu       sync.Mutex
+	clock    clock
+	debounce func() time.Duration
+	fire     func(nsID int)
+
+	timer      stoppable
+	generation uint64
+	stats      schedulerStats
+}
+
+func newScheduler(c clock, debounce func() time.Duration, fire func(nsID int)) *scheduler {
+	return &scheduler{clock: c, debounce: debounce, fire: fire}
+}
+
+// trigger schedules fire after the debounce, merging with any trigger that
+// hasn't fired yet.
+func (s *scheduler) trigger(nsID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.triggers++
+
+	if s.timer != nil {
+		if s.timer.Stop() {
+			s.stats.merged++
+		}
+	}
+
+	s.generation++
+	generation := s.generation
+
+	s.timer = s.clock.AfterFunc(s.debounce(), func() {
+		s.mu.Lock()
+		if generation != s.generation {
+			// superseded by a later trigger after Stop lost the race
+			s.stats.dropped++
+			s.mu.Unlock()
+			return
+		}
+		s.timer = nil
+		s.stats.fired++
+		s.mu.Unlock()
+
+		s.fire(nsID)
+	})
+}
+
+// drop counts a fired trigger that was given up on before making a
+// request.
+func (s *scheduler) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.dropped++
+}
+
+func (s *scheduler) snapshot() schedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock runs timers when advance moves past their deadline. With
+// stopFails set Stop reports the timer as already fired, like time.Timer
+// does when its func has just started, while leaving it to run.
+type fakeClock struct {
+	mu        sync.Mutex
+	now       time.Duration
+	timers    []*fakeTimer
+	stopFails bool
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Duration
+	f       func()
+	stopped bool
+	fired   bool
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) stoppable {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now + d, f: f}
+	c.timers = append(c.timers, t)
+
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	if t.fired || t.stopped || t.clock.stopFails {
+		return false
+	}
+	t.stopped = true
+
+	return true
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now += d
+
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if !t.fired && !t.stopped && t.at <= c.now {
+			t.fired = true
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func newTestScheduler(c *fakeClock, debounce time.Duration) (*scheduler, *[]int) {
+	var fired []int
+	s := newScheduler(c, func() time.Duration { return debounce }, func(nsID int) {
+		fired = append(fired, nsID)
+	})
+
+	return s, &fired
+}
+
+func TestSchedulerDebounces(t *testing.T) {
+	c := &fakeClock{}
+	s, fired := newTestScheduler(c, 100*time.Millisecond)
+
+	s.trigger(1)
+	c.advance(99 * time.Millisecond)
+	if len(*fired) != 0 {
+		t.Fatalf("fired before the debounce elapsed")
+	}
+
+	c.advance(time.Millisecond)
+	if len(*fired) != 1 || (*fired)[0] != 1 {
+		t.Fatalf("fired = %v, want [1]", *fired)
+	}
+
+	want := schedulerStats{triggers: 1, fired: 1}
+	if got := s.snapshot(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestSchedulerMergesBursts(t *testing.T) {
+	c := &fakeClock{}
+	s, fired := newTestScheduler(c, 100*time.Millisecond)
+
+	for i := range 5 {
+		s.trigger(i)
+		c.advance(50 * time.Millisecond)
+	}
+	if len(*fired) != 0 {
+		t.Fatalf("fired = %v while still typing", *fired)
+	}
+
+	c.advance(50 * time.Millisecond)
+	if len(*fired) != 1 || (*fired)[0] != 4 {
+		t.Fatalf("fired = %v, want only the last trigger", *fired)
+	}
+
+	want := schedulerStats{triggers: 5, merged: 4, fired: 1}
+	if got := s.snapshot(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestSchedulerPicksUpDebounceChanges(t *testing.T) {
+	c := &fakeClock{}
+	debounce := 100 * time.Millisecond
+
+	var fired int
+	s := newScheduler(c, func() time.Duration { return debounce }, func(int) { fired++ })
+
+	s.trigger(0)
+	c.advance(100 * time.Millisecond)
+
+	debounce = 300 * time.Millisecond
+	s.trigger(0)
+	c.advance(200 * time.Millisecond)
+	if fired != 1 {
+		t.Fatalf("fired %d times before the new debounce elapsed, want 1", fired)
+	}
+
+	c.advance(100 * time.Millisecond)
+	if fired != 2 {
+		t.Errorf("fired %d times, want 2", fired)
+	}
+}
+
+func TestSchedulerDropsSupersededTimer(t *testing.T) {
+	c := &fakeClock{stopFails: true}
+	s, fired := newTestScheduler(c, 100*time.Millisecond)
+
+	s.trigger(1)
+	s.trigger(2)
+	c.advance(100 * time.Millisecond)
+
+	if len(*fired) != 1 || (*fired)[0] != 2 {
+		t.Fatalf("fired = %v, want only the last trigger", *fired)
+	}
+
+	want := schedulerStats{triggers: 2, dropped: 1, fired: 1}
+	if got := s.snapshot(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestSchedulerCountsDrops(t *testing.T) {
+	c := &fakeClock{}
+
+	var s *scheduler
+	s = newScheduler(c, func() time.Duration { return time.Millisecond }, func(int) {
+		// as crunchCppStream does when it can't make the request
+		s.drop()
+	})
+
+	s.trigger(0)
+	c.advance(time.Millisecond)
+
+	want := schedulerStats{triggers: 1, dropped: 1, fired: 1}
+	if got := s.snapshot(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
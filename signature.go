@@ -0,0 +1,162 @@
+package main
+
+import (
+	v1 "connectrpc/cursor/gen/v1"
+	"log"
+	"time"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// maxCallScanLines is how far back we look for the opening paren of the
+// call the cursor is in.
+const maxCallScanLines = 10
+
+// signatureHelpLua requests textDocument/signatureHelp at the cursor and
+// reports the active signature's parameters back with an rpcnotify to
+// cursortab_signature_help.
+const signatureHelpLua = `
+local chan, id, bufnr, line, col = ...
+local client = vim.lsp.get_clients({ bufnr = bufnr, method = "textDocument/signatureHelp" })[1]
+if not client then
+	vim.rpcnotify(chan, "cursortab_signature_help", id, {})
+	return
+end
+
+local params = {
+	textDocument = vim.lsp.util.make_text_document_params(bufnr),
+	position = {
+		line = line,
+		character = vim.lsp.util.character_offset(bufnr, line, col, client.offset_encoding),
+	},
+}
+
+local function doc_text(doc)
+	if type(doc) == "table" then
+		return doc.value or ""
+	end
+	return doc or ""
+end
+
+vim.lsp.buf_request_all(bufnr, "textDocument/signatureHelp", params, function(responses)
+	local hints = {}
+	for _, resp in pairs(responses) do
+		local res = resp.result
+		if res and res.signatures and #res.signatures > 0 then
+			local sig = res.signatures[(res.activeSignature or 0) + 1] or res.signatures[1]
+			for _, p in ipairs(sig.parameters or {}) do
+				local label = p.label
+				if type(label) == "table" then
+					label = sig.label:sub(label[1] + 1, label[2])
+				end
+				table.insert(hints, { label = label, documentation = doc_text(p.documentation) })
+			end
+			break
+		end
+	end
+	vim.rpcnotify(chan, "cursortab_signature_help", id, hints)
+end)
+`
+
+type parameterHint struct {
+	Label         string `msgpack:"label"`
+	Documentation string `msgpack:"documentation"`
+}
+
+// signatureHelp fetches parameter hints for the call around the cursor.
+type signatureHelp struct {
+	waiters *luaWaiters[[]parameterHint]
+}
+
+func newSignatureHelp() *signatureHelp {
+	return &signatureHelp{waiters: newLuaWaiters[[]parameterHint]()}
+}
+
+func (sh *signatureHelp) register(v *nvim.Nvim) error {
+	return v.RegisterHandler("cursortab_signature_help", func(id int, hints []parameterHint) {
+		sh.waiters.resolve(id, hints)
+	})
+}
+
+// collect returns the parameter hints of the active signature when the
+// cursor of b is inside a call's argument list, waiting at most budget.
+func (sh *signatureHelp) collect(v *nvim.Nvim, b *buffer, budget time.Duration) []*v1.CppParameterHint {
+	if budget <= 0 || !insideCallArgs(b.lines, b.col, b.row) {
+		return nil
+	}
+
+	hints, ok, err := sh.waiters.wait(budget, func(id int) error {
+		return v.ExecLua(signatureHelpLua, nil, v.ChannelID(), id, b.id, b.col, b.row)
+	})
+	if err != nil {
+		log.Printf("error requesting signature help: %v", err)
+		return nil
+	}
+	if !ok {
+		log.Printf("signature help exceeded budget of %v", budget)
+		return nil
+	}
+
+	return parameterHints(hints)
+}
+
+func parameterHints(hints []parameterHint) []*v1.CppParameterHint {
+	out := make([]*v1.CppParameterHint, 0, len(hints))
+
+	for _, hint := range hints {
+		paramHint := &v1.CppParameterHint{Label: hint.Label}
+		if hint.Documentation != "" {
+			doc := hint.Documentation
+			paramHint.Documentation = &doc
+		}
+
+		out = append(out, paramHint)
+	}
+
+	return out
+}
+
+// insideCallArgs reports whether the 0 based position line, col sits after
+// an unclosed paren, scanning back at most maxCallScanLines lines. Quoted
+// parens are skipped on a best effort basis.
+func insideCallArgs(lines []string, line, col int) bool {
+	if line < 0 || line >= len(lines) {
+		return false
+	}
+
+	depth := 0
+
+	for i := line; i >= 0 && i > line-maxCallScanLines; i-- {
+		text := lines[i]
+		if i == line {
+			text = text[:min(col, len(text))]
+		}
+
+		var quote byte
+		opens := 0
+		for j := 0; j < len(text); j++ {
+			c := text[j]
+			switch {
+			case quote != 0:
+				if c == '\\' {
+					j++
+				} else if c == quote {
+					quote = 0
+				}
+			case c == '"' || c == '\'' || c == '`':
+				quote = c
+			case c == '(':
+				opens++
+			case c == ')':
+				opens--
+			}
+		}
+
+		depth += opens
+		if depth > 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,34 +2,45 @@ package main
 
 import (
 	v1 "connectrpc/cursor/gen/v1"
-	aiserverv1connect "connectrpc/cursor/gen/v1/aiserverv1connect"
 	"context"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
+	"connectrpc.com/connect"
 	"github.com/neovim/go-client/nvim"
 	"google.golang.org/protobuf/proto"
 )
 
 type state struct {
-	buffer        *buffer
-	v             *nvim.Nvim
-	service       aiserverv1connect.AiServiceClient
-	workspacePath string
-	workspaceID   string
-	context       context.Context
-	cancel        context.CancelFunc
-	accessToken   string
-	checksum      string
-
-	applyBatch   *nvim.Batch
+	cfg          *config
+	buffers      *bufferRegistry
+	v            *nvim.Nvim
+	endpoints    *endpoints
+	workspaceIDs *workspaceIDs
+	context      context.Context
+	cancel       context.CancelFunc
+	contextMu    *sync.Mutex
+	tokens       *tokenManager
+	machine      *machineIdentity
+
 	applyBatchMu *sync.Mutex
+
+	cppConfig *cppConfigStore
+	scheduler *scheduler
+	diffs     *diffRecorder
+	lsp       *lspContext
+	signature *signatureHelp
+	filesync  *filesync
+	reporter  *errorReporter
+	status    *statusTracker
 }
 
-func newState() (*state, error) {
-	service := newAiServiceClient()
+func newState(cfg *config) (*state, error) {
+	endpoints := newEndpoints(cfg)
 	log.Printf("service created")
 
 	v, err := nvim.New(
@@ -42,211 +53,563 @@ func newState() (*state, error) {
 	log.Printf("nvim created")
 
 	context, cancel := context.WithCancel(context.Background())
-	accessToken, err := getAccessToken()
-	if err != nil {
-		cancel()
-		return nil, err
-	}
-	checksum := generateChecksum("hi")
-	workspacePath := "~"
-
-	workspaceID := "a-b-c-d-e-f-g"
 
-	buffer, err := newBuffer()
-	if err != nil {
-		cancel()
-		return nil, err
+	// without credentials keep running with an empty token: the first
+	// request is rejected and refreshing rereads the state database, so
+	// signing in to Cursor later is picked up
+	creds, credsErr := loadCredentials(cfg.StateDB)
+	if credsErr != nil {
+		creds = &cursorCredentials{}
 	}
+	tokens := newTokenManager(creds, cfg.AuthURL, &http.Client{Timeout: cfg.timeout()}, func() (*cursorCredentials, error) {
+		return loadCredentials(cfg.StateDB)
+	})
+	machine := newMachineIdentity(creds)
+	buffers := newBufferRegistry()
 
-	log.Printf("buffer created: %v", buffer)
-
-	var applyBatch *nvim.Batch
 	applyBatchMu := &sync.Mutex{}
 
-	return &state{
-		buffer,
+	s := &state{
+		cfg,
+		buffers,
 		v,
-		service,
-		workspacePath,
-		workspaceID,
+		endpoints,
+		newWorkspaceIDs(workspaceIDsPath()),
 		context,
 		cancel,
-		accessToken,
-		checksum,
-		applyBatch,
+		&sync.Mutex{},
+		tokens,
+		machine,
 		applyBatchMu,
-	}, nil
+		newCppConfigStore(),
+		nil,
+		newDiffRecorder(),
+		newLspContext(),
+		newSignatureHelp(),
+		newFilesync(cfg.Filesync),
+		nil,
+		nil,
+	}
+
+	s.reporter = newErrorReporter(s.showError)
+	s.status = newStatusTracker(s.publishStatus)
+
+	if credsErr != nil {
+		// Neovim only answers once init starts serving
+		go s.reporter.report("loading cursor credentials", credsErr)
+	}
+
+	s.scheduler = newScheduler(realClock{}, s.debounce, func(nsID int) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("recovered from panic: %v", r)
+			}
+		}()
+		s.crunchCppStream(nsID, -1)
+	})
+
+	return s, nil
+}
+
+// debounce is how long typing has to pause before a completion is requested,
+// the configured value if set and the server's otherwise.
+func (s *state) debounce() time.Duration {
+	if s.cfg.Debounce > 0 {
+		return time.Duration(s.cfg.Debounce)
+	}
+
+	return s.cppConfig.get().debounce
+}
+
+// contentWindow picks the lines of b sent as the current file. With
+// filesync the server keeps the whole file, so nothing is windowed.
+func (s *state) contentWindow(b *buffer, settings cppSettings) contentWindow {
+	threshold := s.cfg.WindowThreshold
+	if s.cfg.Filesync {
+		threshold = 0
+	}
+
+	return windowAround(len(b.lines), b.col, settings.aboveRadius, settings.belowRadius, threshold)
+}
+
+// languageContext looks up LSP context and signature help side by side,
+// so together they wait at most one LspBudget.
+func (s *state) languageContext(b *buffer, ws workspace) ([]*v1.LspSubgraphFullContext, []*v1.CppContextItem, []*v1.CppParameterHint) {
+	budget := time.Duration(s.cfg.LspBudget)
+
+	var hints []*v1.CppParameterHint
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hints = s.signature.collect(s.v, b, budget)
+	}()
+
+	contexts, items := s.lsp.collect(s.v, b, ws, budget)
+	wg.Wait()
+
+	return contexts, items, hints
 }
 
 func (s *state) init() error {
-	if err := s.v.RegisterHandler("cursortab_sync", func(v *nvim.Nvim, nsID int) {
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("recovered from panic: %v", r)
-				}
-			}()
-			s.crunchCppStream(nsID, nil)
-		}()
-	}); err != nil {
-		log.Printf("error registering handler: %v", err)
-		return nil
+	registrations := []struct {
+		what     string
+		register func() error
+	}{
+		{"buffer event handlers", func() error { return s.buffers.register(s.v) }},
+		{"lsp context handler", func() error { return s.lsp.register(s.v) }},
+		{"signature help handler", func() error { return s.signature.register(s.v) }},
+		{"cursortab_sync handler", func() error {
+			return s.v.RegisterHandler("cursortab_sync", func(v *nvim.Nvim, nsID int) {
+				s.scheduler.trigger(nsID)
+			})
+		}},
+		{"cursortab_tab_key handler", func() error {
+			return s.v.RegisterHandler("cursortab_tab_key", func(_ *nvim.Nvim, nsID int) {
+				s.tabKey(nsID)
+			})
+		}},
+		{"cursortab_reject handler", func() error {
+			return s.v.RegisterHandler("cursortab_reject", func(_ *nvim.Nvim, nsID int) {
+				s.reject(nsID)
+			})
+		}},
+		{"cursortab_accept_line handler", func() error {
+			return s.v.RegisterHandler("cursortab_accept_line", func(_ *nvim.Nvim, nsID int) {
+				s.acceptPart(nsID, (*suggestion).acceptLine)
+			})
+		}},
+		{"cursortab_accept_word handler", func() error {
+			return s.v.RegisterHandler("cursortab_accept_word", func(_ *nvim.Nvim, nsID int) {
+				s.acceptPart(nsID, (*suggestion).acceptWord)
+			})
+		}},
+		{"status handler", s.registerStatus},
 	}
 
-	if err := s.v.RegisterHandler("cursortab_tab_key", func(_ *nvim.Nvim, nsID int) {
-		s.tabKey(nsID)
-	}); err != nil {
-		log.Printf("error registering handler: %v", err)
-		return nil
+	// keep serving with whatever registered, so the failure reaches Neovim
+	// instead of the plugin quietly exiting; Neovim only answers once Serve
+	// runs
+	for _, r := range registrations {
+		if err := r.register(); err != nil {
+			go s.reporter.reportAs(errorEditor, "registering "+r.what, err)
+		}
 	}
 
+	go s.watchCppConfig(context.Background())
+	go s.watchEndpoints(context.Background())
+
 	return s.v.Serve()
 }
 
-func (s *state) crunchCppStream(nsID int, applyBatch *nvim.Batch) {
-	log.Printf("starting stream")
+// crunchCppStream asks for a suggestion at the cursor and previews it. jump
+// is the 0 based line cursor prediction moved to, -1 when typing.
+func (s *state) crunchCppStream(nsID int, jump int) {
+	stats := s.scheduler.snapshot()
+	log.Printf("starting stream (triggers: %d, merged: %d, dropped: %d, fired: %d)", stats.triggers, stats.merged, stats.dropped, stats.fired)
+
+	settings := s.cppConfig.get()
+	if !settings.enabled {
+		log.Printf("cpp disabled by server config")
+		s.scheduler.drop()
+		return
+	}
+
+	b, err := s.currentBuffer()
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "getting current buffer", err)
+		return
+	}
+
+	synced, ok := s.syncBuffer(b, nsID)
+	if !ok {
+		s.scheduler.drop()
+		return
+	}
 
 	if ok := s.applyBatchMu.TryLock(); !ok {
 		log.Printf("applyBatch is already in use")
+		s.scheduler.drop()
 		return
 	}
 
-	s.applyBatch = nil
+	oldCol := b.col
+	b.store(synced)
+
+	// the sync a partial accept causes finds the buffer at the changedtick
+	// the rest of the suggestion was made against, keep showing that
+	if b.pending != nil && b.pending.tick == b.tick {
+		log.Printf("buffer unchanged since the suggestion, keeping it")
+		s.applyBatchMu.Unlock()
+		return
+	}
+
+	invalidated := b.pending != nil
+	b.pending = nil
+
+	// the request is built from and compared against this copy, a partial
+	// accept may change b while it streams
+	cur := b.snapshot()
 	s.applyBatchMu.Unlock()
+	s.status.suggestionReady(false)
+
+	// typing past a suggestion leaves its preview behind otherwise
+	if invalidated {
+		batch := s.v.NewBatch()
+		b.clearNamespace(batch, nsID)
+		b.clearSuggestion(batch)
+
+		if err := batch.Execute(); err != nil {
+			s.reporter.reportAs(errorEditor, "clearing invalidated suggestion", err)
+		}
+	}
+
+	reqCtx := s.restartContext()
+
+	window := s.contentWindow(cur, settings)
+
+	cursorPos := cursorPosition(window.relative(cur.col), cur.row)
 
-	oldCol := s.buffer.col
+	version := int32(cur.version)
 
-	s.buffer.syncIn(s.v)
-	s.restartContext()
+	contents := window.contents(cur.lines)
 
-	cursorPos := &v1.CursorPosition{
-		Line:   int32(s.buffer.col + 1),
-		Column: int32(s.buffer.row),
+	diags, err := s.bufferDiagnostics(b.id)
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "getting diagnostics", err)
 	}
+	diags = window.diagnostics(cur.lines, rankDiagnostics(diags, cur.col))
 
-	version := int32(s.buffer.version)
+	ws, err := s.bufferWorkspace(cur)
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "detecting workspace", err)
+	}
+	relPath := ws.relative(cur.path)
 
 	currentFile := &v1.CurrentFileInfo{
-		Contents:              strings.Join(s.buffer.lines, "\n"),
+		Contents:              contents,
+		ContentsStartAtLine:   int32(window.start),
+		TotalNumberOfLines:    int32(window.total),
 		CursorPosition:        cursorPos,
 		FileVersion:           &version,
-		RelativeWorkspacePath: s.buffer.path,
+		RelativeWorkspacePath: relPath,
+		LanguageId:            languageID(ws.Filetype),
+		WorkspaceRootPath:     ws.Root,
+		Diagnostics:           fileDiagnostics(diags),
 	}
 
 	source := "typing"
-	if s.applyBatch != nil {
+	if jump >= 0 {
 		source = "cursor_prediction"
-	} else if oldCol != s.buffer.col {
+	} else if oldCol != cur.col {
 		source = "line_changed"
 	}
 
+	openBufs, err := s.openBuffers()
+	if err != nil {
+		log.Printf("error listing open buffers: %v", err)
+	}
+
+	lspContexts, contextItems, parameterHints := s.languageContext(cur, ws)
+
 	req := &v1.StreamCppRequest{
-		WorkspaceId: &s.workspaceID,
+		WorkspaceId: s.workspaceIDs.field(ws.Root),
 		CurrentFile: currentFile,
 		CppIntentInfo: &v1.CppIntentInfo{
 			// "line_changed" || "typing"
 			Source: source,
 		},
-		FileDiffHistories: []*v1.CppFileDiffHistory{
-			{
-				FileName:    s.buffer.path,
-				DiffHistory: s.buffer.diffHistory,
-			},
-		},
-		IsDebug:         proto.Bool(false),
-		GiveDebugOutput: proto.Bool(false),
+		FileDiffHistories: s.diffs.fileHistories(ws),
+		AdditionalFiles:   additionalFiles(openBufs, cur.path, ws, s.cfg.MaxOpenFiles, s.cfg.MaxOpenBytes),
+		LinterErrors:      linterErrors(relPath, contents, diags),
+		LspContexts:       lspContexts,
+		ContextItems:      contextItems,
+		ParameterHints:    parameterHints,
+		IsDebug:           proto.Bool(false),
+		GiveDebugOutput:   proto.Bool(false),
 	}
 
-	stream, err := s.service.StreamCpp(s.context, newRequest(s.accessToken, s.checksum, req))
+	ep := s.endpoints.completions()
+
+	ctx, cancel := context.WithTimeout(reqCtx, ep.timeout)
+	defer cancel()
+
+	requestDone := s.status.requestStarted(req.GetModelName())
+	succeeded := false
+	defer func() { requestDone(succeeded) }()
+
+	stream, ok, upload, err := openSynced(s.filesync, s.filesync.prepare(ws, cur.path, contents), func(upload *filesyncUpload) (*connect.ServerStreamForClient[v1.StreamCppResponse], bool, error) {
+		currentFile.Contents = contents
+		upload.currentFile(currentFile)
+		req.FilesyncUpdates = upload.updates
+		if req.LinterErrors != nil {
+			req.LinterErrors.FileContents = currentFile.Contents
+		}
+
+		return openStream(ctx, s.tokens, ep.client.StreamCpp, func(accessToken string) *connect.Request[v1.StreamCppRequest] {
+			return newRequest(s.cfg, accessToken, s.machine, req)
+		})
+	})
 	if err != nil {
-		log.Printf("error starting stream: %v", err)
+		s.reporter.report("starting completion", err)
+		s.completionFailed(ep, err)
 		return
 	}
+	defer stream.Close()
+
+	s.applyBatchMu.Lock()
+	b.streams++
+	streamID := b.streams
+	b.streaming = streamID
+	b.acceptOnDone = false
+	s.applyBatchMu.Unlock()
+
+	shown := false
+	previewed := 0
+
+	defer func() {
+		s.applyBatchMu.Lock()
+		if b.streaming != streamID {
+			s.applyBatchMu.Unlock()
+			return
+		}
+
+		b.streaming = 0
+
+		var accepted *suggestion
+		if b.acceptOnDone && shown {
+			accepted = b.pending
+			b.pending = nil
+		}
+		b.acceptOnDone = false
+		s.applyBatchMu.Unlock()
+
+		if accepted != nil {
+			s.accept(b, accepted, nsID)
+		} else if previewed > 0 && !shown {
+			s.clearPreview(b, nsID)
+		}
+	}()
 
 	startLine := 0
 	endLineInc := 0
+	rangeKnown := false
 	newText := ""
+	var confidence *int32
 
-	for stream.Receive() {
+	for ; ok; ok = stream.Receive() {
 		msg := stream.Msg()
 
 		if msg.RangeToReplace != nil {
-			startLine = int(msg.RangeToReplace.StartLineNumber - 1)
-			endLineInc = int(msg.RangeToReplace.EndLineNumberInclusive - 1)
+			startLine, endLineInc = window.replaced(msg.RangeToReplace.StartLineNumber, msg.RangeToReplace.EndLineNumberInclusive)
+			rangeKnown = true
 		}
 
 		if msg.SuggestionStartLine != nil {
 			log.Printf("suggestion start line: %v", msg.SuggestionStartLine)
 		}
 
+		if msg.SuggestionConfidence != nil {
+			confidence = msg.SuggestionConfidence
+		}
+
 		newText += msg.Text
 
 		if msg.DoneStream != nil && *msg.DoneStream {
 			break
 		}
+
+		// preview the lines completed so far, the rest is still arriving
+		complete := strings.Count(newText, "\n")
+		if rangeKnown && complete > previewed && !lowConfidence(confidence, s.cfg.MinConfidence) {
+			lines := strings.Split(newText, "\n")[:complete]
+			partial := newSuggestion(cur.lines, startLine, min(endLineInc, startLine+complete-1), lines)
+			partial.jump = jump
+			if err := b.preview(s.v, nsID, partial); err != nil {
+				s.reporter.reportAs(errorEditor, "previewing partial suggestion", err)
+			}
+			previewed = complete
+		}
 	}
 
 	log.Printf("stream finished: %s (%v, %v)", newText, startLine, endLineInc)
 
 	if err := stream.Err(); err != nil {
-		log.Printf("stream error: %v", err)
+		s.reporter.report("streaming completion", err)
+		s.completionFailed(ep, err)
+		return
+	}
+
+	succeeded = true
+	s.filesync.ack(upload)
+
+	newLines := strings.Split(newText, "\n")
+
+	var oldLines []string
+	if startLine < len(cur.lines) {
+		oldLines = cur.lines[startLine:max(startLine, min(endLineInc+1, len(cur.lines)))]
+	}
+
+	var after *string
+	if endLineInc+1 < len(cur.lines) {
+		after = &cur.lines[endLineInc+1]
+	}
+
+	if h, rejected := settings.rejectedByHeuristics(oldLines, newLines, after); rejected {
+		log.Printf("suggestion rejected by %v", h)
 		return
 	}
 
 	log.Printf("editing lines: %v, %v", startLine, endLineInc)
 
-	s.applyBatch = s.buffer.editLines(s.v, applyBatch, nsID, startLine, endLineInc, strings.Split(newText, "\n"))
+	if lowConfidence(confidence, s.cfg.MinConfidence) {
+		log.Printf("suggestion dropped, confidence %d below %d", *confidence, s.cfg.MinConfidence)
+		return
+	}
+
+	pending := newSuggestion(cur.lines, startLine, endLineInc, newLines)
+	pending.jump = jump
+	pending.tick = cur.tick
+	pending.confidence = confidence
+
+	if pending.empty() {
+		log.Printf("suggestion doesn't change anything")
+		if previewed > 0 {
+			s.clearPreview(b, nsID)
+		}
+		return
+	}
+
+	if err := b.preview(s.v, nsID, pending); err != nil {
+		s.reporter.reportAs(errorEditor, "previewing suggestion", err)
+		return
+	}
+
+	s.applyBatchMu.Lock()
+	b.pending = pending
+	shown = true
+	s.applyBatchMu.Unlock()
+
+	s.status.suggestionReady(true)
+	s.suggestionShown(b, confidence)
 }
 
 func (s *state) predictNextCursorPrediction(nsID int) {
+	b, err := s.currentBuffer()
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "getting current buffer", err)
+		return
+	}
+
+	synced, ok := s.syncBuffer(b, nsID)
+	if !ok {
+		return
+	}
+
 	log.Printf("aquiring cursor prediction lock")
 
 	s.applyBatchMu.Lock()
+	b.store(synced)
 
-	s.buffer.syncIn(s.v)
-	s.restartContext()
+	reqCtx := s.restartContext()
 
 	log.Printf("predicting next cursor prediction")
 
-	version := int32(s.buffer.version)
+	settings := s.cppConfig.get()
+	window := s.contentWindow(b, settings)
+
+	version := int32(b.version)
+
+	cursorPos := cursorPosition(window.relative(b.col), b.row)
 
-	cursorPos := &v1.CursorPosition{
-		Line:   int32(s.buffer.col + 1),
-		Column: int32(s.buffer.row),
+	contents := window.contents(b.lines)
+
+	diags, err := s.bufferDiagnostics(b.id)
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "getting diagnostics", err)
+	}
+	diags = window.diagnostics(b.lines, rankDiagnostics(diags, b.col))
+
+	ws, err := s.bufferWorkspace(b)
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "detecting workspace", err)
 	}
+	relPath := ws.relative(b.path)
 
 	currentFile := &v1.CurrentFileInfo{
-		Contents:              strings.Join(s.buffer.lines, "\n"),
+		Contents:              contents,
+		ContentsStartAtLine:   int32(window.start),
+		TotalNumberOfLines:    int32(window.total),
 		CursorPosition:        cursorPos,
 		FileVersion:           &version,
-		RelativeWorkspacePath: s.buffer.path,
+		RelativeWorkspacePath: relPath,
+		LanguageId:            languageID(ws.Filetype),
+		WorkspaceRootPath:     ws.Root,
+		Diagnostics:           fileDiagnostics(diags),
+	}
+
+	openBufs, err := s.openBuffers()
+	if err != nil {
+		log.Printf("error listing open buffers: %v", err)
 	}
 
+	lspContexts, contextItems, parameterHints := s.languageContext(b, ws)
+
 	req := &v1.StreamNextCursorPredictionRequest{
-		CurrentFile:     currentFile,
-		DiffHistory:     s.buffer.diffHistory,
-		WorkspaceId:     &s.workspaceID,
-		IsDebug:         proto.Bool(false),
-		GiveDebugOutput: proto.Bool(false),
+		CurrentFile:       currentFile,
+		FileVisibleRanges: fileVisibleRanges(openBufs, ws, s.cfg.MaxOpenFiles+1),
+		LinterErrors:      linterErrors(relPath, contents, diags),
+		LspContexts:       lspContexts,
+		ContextItems:      contextItems,
+		ParameterHints:    parameterHints,
+		DiffHistory:       s.diffs.history(b.path),
+		FileDiffHistories: s.diffs.fileHistories(ws),
+		WorkspaceId:       s.workspaceIDs.field(ws.Root),
+		IsDebug:           proto.Bool(false),
+		GiveDebugOutput:   proto.Bool(false),
 		CppIntentInfo: &v1.CppIntentInfo{
 			Source: "line_changed",
 		},
 	}
 
-	stream, err := s.service.StreamNextCursorPrediction(s.context, newRequest(s.accessToken, s.checksum, req))
+	ep := s.endpoints.completions()
+
+	ctx, cancel := context.WithTimeout(reqCtx, ep.timeout)
+	defer cancel()
+
+	requestDone := s.status.requestStarted(req.GetModelName())
+
+	stream, ok, upload, err := openSynced(s.filesync, s.filesync.prepare(ws, b.path, contents), func(upload *filesyncUpload) (*connect.ServerStreamForClient[v1.StreamNextCursorPredictionResponse], bool, error) {
+		currentFile.Contents = contents
+		upload.currentFile(currentFile)
+		req.FileSyncUpdates = upload.updates
+		if req.LinterErrors != nil {
+			req.LinterErrors.FileContents = currentFile.Contents
+		}
+
+		return openStream(ctx, s.tokens, ep.client.StreamNextCursorPrediction, func(accessToken string) *connect.Request[v1.StreamNextCursorPredictionRequest] {
+			return newRequest(s.cfg, accessToken, s.machine, req)
+		})
+	})
 	if err != nil {
-		log.Printf("error starting stream: %v", err)
+		s.reporter.report("starting cursor prediction", err)
+		s.completionFailed(ep, err)
+		requestDone(false)
 
 		s.applyBatchMu.Unlock()
 		return
 	}
+	defer stream.Close()
 
 	lineNumber := 0
 
-	for stream.Receive() {
+	for ; ok; ok = stream.Receive() {
 		msg := stream.Msg()
 		log.Printf("predicted line number: %v", msg.LineNumber)
-		lineNumber = int(msg.LineNumber)
+		lineNumber = 0
+		if msg.LineNumber > 0 {
+			lineNumber = window.absolute(int(msg.LineNumber-1)) + 1
+		}
 
 		if msg.IsNotInRange {
 			lineNumber = 0
@@ -255,41 +618,259 @@ func (s *state) predictNextCursorPrediction(nsID int) {
 	}
 
 	if err := stream.Err(); err != nil {
-		log.Printf("cursor predict stream error: %v", err)
+		s.reporter.report("streaming cursor prediction", err)
+		s.completionFailed(ep, err)
+		requestDone(false)
 		s.applyBatchMu.Unlock()
 		return
 	}
 
+	requestDone(true)
+	s.filesync.ack(upload)
+
+	jump := -1
 	if lineNumber != 0 {
-		s.applyBatch = s.buffer.setCursorPosition(s.v, nsID, lineNumber-1)
+		jump = lineNumber - 1
 	}
 	s.applyBatchMu.Unlock()
 
-	s.crunchCppStream(nsID, s.applyBatch)
+	s.crunchCppStream(nsID, jump)
 }
 
 func (s *state) tabKey(nsID int) {
+	b, err := s.currentBuffer()
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "getting current buffer", err)
+		return
+	}
+
+	s.discardStale(b.id, nsID)
+
 	log.Printf("aquiring tab key lock")
 
 	s.applyBatchMu.Lock()
-	applyBatch := s.applyBatch
-	s.applyBatch = nil
+	sg := b.pending
+	b.pending = nil
+	deferred := sg == nil && b.streaming != 0
+	if deferred {
+		b.acceptOnDone = true
+	}
+	s.applyBatchMu.Unlock()
+
+	if deferred {
+		log.Printf("suggestion still streaming, accepting once it's done")
+		return
+	}
+
+	if sg == nil {
+		log.Printf("no pending suggestion")
+		return
+	}
+
+	s.accept(b, sg, nsID)
+}
+
+// accept applies a suggestion and looks for where the cursor should go
+// next.
+func (s *state) accept(b *buffer, sg *suggestion, nsID int) {
+	s.status.suggestionReady(false)
+
+	s.applyBatchMu.Lock()
+	lines := b.lines
+	s.applyBatchMu.Unlock()
+
+	var tick int
+	applyBatch := s.v.NewBatch()
+	b.apply(applyBatch, nsID, sg, lines, &tick)
+	b.clearSuggestion(applyBatch)
+
+	if err := applyBatch.Execute(); err != nil {
+		s.reporter.reportAs(errorEditor, "applying suggestion", err)
+		return
+	}
+
+	if tick < 0 {
+		log.Printf("buffer changed since the suggestion was made, dropped it")
+		return
+	}
+
+	s.applyBatchMu.Lock()
+	b.version++
 	s.applyBatchMu.Unlock()
 
-	if applyBatch == nil {
-		log.Printf("no apply batch")
-	} else {
-		if err := applyBatch.Execute(); err != nil {
-			log.Printf("error executing tab key batch: %v", err)
+	log.Printf("predicting")
+
+	go s.predictNextCursorPrediction(nsID)
+}
+
+// acceptPart applies the part of the pending suggestion split picks and
+// keeps previewing the rest. Once nothing is left it behaves like tab.
+func (s *state) acceptPart(nsID int, split func(*suggestion) (accepted, rest *suggestion)) {
+	b, err := s.currentBuffer()
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "getting current buffer", err)
+		return
+	}
+
+	s.discardStale(b.id, nsID)
+
+	s.applyBatchMu.Lock()
+	sg := b.pending
+	b.pending = nil
+	lines := b.lines
+	s.applyBatchMu.Unlock()
+
+	if sg == nil {
+		log.Printf("no pending suggestion")
+		return
+	}
+
+	accepted, rest := split(sg)
+	if rest == nil {
+		s.accept(b, accepted, nsID)
+		return
+	}
+
+	var tick int
+	applyBatch := s.v.NewBatch()
+	b.apply(applyBatch, nsID, accepted, lines, &tick)
+
+	if err := applyBatch.Execute(); err != nil {
+		s.reporter.reportAs(errorEditor, "applying suggestion", err)
+		return
+	}
+
+	if tick < 0 {
+		log.Printf("buffer changed since the suggestion was made, dropped it")
+		s.status.suggestionReady(false)
+
+		batch := s.v.NewBatch()
+		b.clearSuggestion(batch)
+		if err := batch.Execute(); err != nil {
+			s.reporter.reportAs(errorEditor, "clearing suggestion", err)
 		}
+		return
+	}
 
-		log.Printf("predicting")
+	rest.tick = tick
 
-		go s.predictNextCursorPrediction(nsID)
+	s.applyBatchMu.Lock()
+	b.lines = accepted.appliedTo(lines)
+	b.tick = tick
+	b.version++
+	b.pending = rest
+	s.applyBatchMu.Unlock()
+
+	if err := b.preview(s.v, nsID, rest); err != nil {
+		s.reporter.reportAs(errorEditor, "previewing suggestion", err)
 	}
 }
 
-func (s *state) restartContext() {
+// reject drops the pending suggestion of the current buffer, and stops one
+// still streaming in.
+func (s *state) reject(nsID int) {
+	b, err := s.currentBuffer()
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "getting current buffer", err)
+		return
+	}
+
+	s.applyBatchMu.Lock()
+	b.pending = nil
+	b.acceptOnDone = false
+	streaming := b.streaming != 0
+	s.applyBatchMu.Unlock()
+
+	if streaming {
+		s.restartContext()
+	}
+
+	s.status.suggestionReady(false)
+
+	batch := s.v.NewBatch()
+	b.clearNamespace(batch, nsID)
+	b.clearSuggestion(batch)
+
+	if err := batch.Execute(); err != nil {
+		s.reporter.reportAs(errorEditor, "rejecting suggestion", err)
+	}
+}
+
+// clearPreview removes a preview that never became a suggestion.
+func (s *state) clearPreview(b *buffer, nsID int) {
+	batch := s.v.NewBatch()
+	b.clearNamespace(batch, nsID)
+
+	if err := batch.Execute(); err != nil {
+		s.reporter.reportAs(errorEditor, "clearing preview", err)
+	}
+}
+
+// currentBuffer returns the registry entry for the buffer under the cursor.
+func (s *state) currentBuffer() (*buffer, error) {
+	id, err := s.v.CurrentBuffer()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.buffers.get(id), nil
+}
+
+// syncBuffer reads b in from Neovim, records it in the diff history and
+// drops suggestions still pending in other buffers. The caller stores what
+// was read under applyBatchMu. It reports false if b couldn't be read, so
+// callers don't go on with stale lines.
+func (s *state) syncBuffer(b *buffer, nsID int) (bufferSync, bool) {
+	synced, err := b.syncIn(s.v, s.buffers)
+	if err != nil {
+		s.reporter.reportAs(errorEditor, "syncing buffer", err)
+		return bufferSync{}, false
+	}
+
+	s.diffs.record(synced.path, synced.lines)
+	s.discardStale(b.id, nsID)
+
+	return synced, true
+}
+
+// discardStale drops the pending suggestion of every buffer except current,
+// so switching buffers can't apply an edit computed for another one.
+func (s *state) discardStale(current nvim.Buffer, nsID int) {
+	s.applyBatchMu.Lock()
+	defer s.applyBatchMu.Unlock()
+
+	var batch *nvim.Batch
+	for _, b := range s.buffers.others(current) {
+		if b.pending == nil {
+			continue
+		}
+
+		log.Printf("discarding stale suggestion for buffer %d", b.id)
+		b.pending = nil
+
+		if batch == nil {
+			batch = s.v.NewBatch()
+		}
+		b.clearNamespace(batch, nsID)
+		b.clearSuggestion(batch)
+	}
+
+	if batch != nil {
+		if err := batch.Execute(); err != nil {
+			s.reporter.reportAs(errorEditor, "clearing stale suggestions", err)
+		}
+	}
+}
+
+// restartContext cancels the request in flight, if any, and returns the
+// context the next one should run under. It is called from both the
+// scheduler and RPC handlers, so the swap happens under contextMu.
+func (s *state) restartContext() context.Context {
+	s.contextMu.Lock()
+	defer s.contextMu.Unlock()
+
 	s.cancel()
 	s.context, s.cancel = context.WithCancel(context.Background())
+
+	return s.context
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	keyAccessToken  = "cursorAuth/accessToken"
+	keyRefreshToken = "cursorAuth/refreshToken"
+	keyCachedEmail  = "cursorAuth/cachedEmail"
+	keyMachineID    = "storage.serviceMachineId"
+	keyMacMachineID = "telemetry.macMachineId"
+)
+
+// stateDBBusyTimeout is how many milliseconds a read waits for Cursor to
+// release a lock on the database.
+var stateDBBusyTimeout = 2000
+
+var (
+	// errStateDBMissing is returned when the state database file doesn't exist.
+	errStateDBMissing = errors.New("cursor state database missing")
+
+	// errStateDBLocked is returned when Cursor holds a lock on the database
+	// for longer than we're willing to wait.
+	errStateDBLocked = errors.New("cursor state database locked")
+)
+
+// errStateKeyMissing is returned when a required key isn't in ItemTable,
+// usually because the user never signed in to Cursor.
+type errStateKeyMissing struct {
+	key string
+}
+
+func (e *errStateKeyMissing) Error() string {
+	return fmt.Sprintf("key %q missing from cursor state database", e.key)
+}
+
+// cursorCredentials are the values we read out of Cursor's state database.
+type cursorCredentials struct {
+	accessToken  string
+	refreshToken string
+	email        string
+	machineID    string
+	macMachineID string
+}
+
+// readStateDB looks up keys in the ItemTable of the database at path in a
+// single query. Keys that aren't present are simply absent from the result.
+func readStateDB(path string, keys ...string) (map[string]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", errStateDBMissing, path)
+		}
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", stateDBDSN(path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	defer db.Close()
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(keys)), ",")
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+
+	rows, err := db.Query("SELECT key, value FROM ItemTable WHERE key IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, classifyStateDBError(path, err)
+	}
+	defer rows.Close()
+
+	values := make(map[string]string, len(keys))
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, classifyStateDBError(path, err)
+		}
+		values[key] = strings.TrimSpace(string(value))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, classifyStateDBError(path, err)
+	}
+
+	return values, nil
+}
+
+// stateDBDSN builds a read only URI for the database at path, escaping it
+// so characters like # and % in a directory name reach SQLite intact.
+func stateDBDSN(path string) string {
+	p := filepath.ToSlash(path)
+	if filepath.VolumeName(path) != "" {
+		// file:///C:/... on windows
+		p = "/" + p
+	}
+
+	return (&url.URL{
+		Scheme:   "file",
+		Path:     p,
+		RawQuery: "mode=ro&_pragma=busy_timeout(" + strconv.Itoa(stateDBBusyTimeout) + ")",
+	}).String()
+}
+
+func classifyStateDBError(path string, err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+			return fmt.Errorf("%w: %s", errStateDBLocked, path)
+		}
+	}
+
+	return fmt.Errorf("error reading %s: %w", path, err)
+}
+
+// loadCredentials reads everything we need from the state database. Only the
+// access token is required; the rest are best effort.
+func loadCredentials(override string) (*cursorCredentials, error) {
+	dbPath, err := findStateDB(override)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadCredentialsFrom(dbPath)
+}
+
+func loadCredentialsFrom(dbPath string) (*cursorCredentials, error) {
+	values, err := readStateDB(dbPath, keyAccessToken, keyRefreshToken, keyCachedEmail, keyMachineID, keyMacMachineID)
+	if err != nil {
+		return nil, err
+	}
+
+	if values[keyAccessToken] == "" {
+		return nil, &errStateKeyMissing{key: keyAccessToken}
+	}
+
+	return &cursorCredentials{
+		accessToken:  values[keyAccessToken],
+		refreshToken: values[keyRefreshToken],
+		email:        values[keyCachedEmail],
+		machineID:    values[keyMachineID],
+		macMachineID: values[keyMacMachineID],
+	}, nil
+}
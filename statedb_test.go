@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeStateDB creates a Cursor style state database at path holding items.
+func writeStateDB(t *testing.T, path string, items map[string]string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite", (&url.URL{Scheme: "file", Path: filepath.ToSlash(path), RawQuery: "mode=rwc"}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("CREATE TABLE ItemTable (key TEXT UNIQUE ON CONFLICT REPLACE, value BLOB)"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range items {
+		if _, err := db.Exec("INSERT INTO ItemTable (key, value) VALUES (?, ?)", key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadStateDB(t *testing.T) {
+	items := map[string]string{
+		keyAccessToken:  "access",
+		keyRefreshToken: " refresh\n",
+		"other":         "unrelated",
+	}
+
+	for _, dir := range []string{"plain", "with space", "hash#dir", "percent%41dir", "question?dir"} {
+		t.Run(dir, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), dir, "state.vscdb")
+			writeStateDB(t, path, items)
+
+			values, err := readStateDB(path, keyAccessToken, keyRefreshToken, keyCachedEmail)
+			if err != nil {
+				t.Fatalf("readStateDB() error = %v", err)
+			}
+
+			want := map[string]string{keyAccessToken: "access", keyRefreshToken: "refresh"}
+			if len(values) != len(want) {
+				t.Errorf("readStateDB() = %q, want %q", values, want)
+			}
+			for key, value := range want {
+				if values[key] != value {
+					t.Errorf("values[%q] = %q, want %q", key, values[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadCredentialsFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.vscdb")
+	writeStateDB(t, path, map[string]string{
+		keyAccessToken:  "access",
+		keyRefreshToken: "refresh",
+		keyCachedEmail:  "me@example.com",
+		keyMachineID:    "machine",
+		keyMacMachineID: "mac",
+	})
+
+	creds, err := loadCredentialsFrom(path)
+	if err != nil {
+		t.Fatalf("loadCredentialsFrom() error = %v", err)
+	}
+
+	want := cursorCredentials{
+		accessToken:  "access",
+		refreshToken: "refresh",
+		email:        "me@example.com",
+		machineID:    "machine",
+		macMachineID: "mac",
+	}
+	if *creds != want {
+		t.Errorf("loadCredentialsFrom() = %+v, want %+v", *creds, want)
+	}
+}
+
+func TestLoadCredentialsErrors(t *testing.T) {
+	t.Run("not found", func(t *testing.T) {
+		_, err := loadCredentials(filepath.Join(t.TempDir(), "missing.vscdb"))
+
+		var notFound *errStateDBNotFound
+		if !errors.As(err, &notFound) {
+			t.Errorf("loadCredentials() error = %v, want errStateDBNotFound", err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := loadCredentialsFrom(filepath.Join(t.TempDir(), "missing.vscdb"))
+		if !errors.Is(err, errStateDBMissing) {
+			t.Errorf("loadCredentialsFrom() error = %v, want errStateDBMissing", err)
+		}
+	})
+
+	t.Run("key missing", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.vscdb")
+		writeStateDB(t, path, map[string]string{keyRefreshToken: "refresh"})
+
+		_, err := loadCredentialsFrom(path)
+
+		var missingKey *errStateKeyMissing
+		if !errors.As(err, &missingKey) || missingKey.key != keyAccessToken {
+			t.Errorf("loadCredentialsFrom() error = %v, want errStateKeyMissing for %s", err, keyAccessToken)
+		}
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		timeout := stateDBBusyTimeout
+		stateDBBusyTimeout = 50
+		t.Cleanup(func() { stateDBBusyTimeout = timeout })
+
+		path := filepath.Join(t.TempDir(), "state.vscdb")
+		writeStateDB(t, path, map[string]string{keyAccessToken: "access"})
+
+		db, err := sql.Open("sqlite", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE"); err != nil {
+			t.Fatal(err)
+		}
+		defer conn.ExecContext(context.Background(), "ROLLBACK")
+
+		_, err = loadCredentialsFrom(path)
+		if !errors.Is(err, errStateDBLocked) {
+			t.Errorf("loadCredentialsFrom() error = %v, want errStateDBLocked", err)
+		}
+	})
+}
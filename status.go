@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+const (
+	statusIdle       = "idle"
+	statusRequesting = "requesting"
+	statusSuggestion = "suggestion"
+)
+
+// statusPublishLua fires User CursorTabStatus with the snapshot as data.
+const statusPublishLua = `
+local status = ...
+vim.api.nvim_exec_autocmds("User", {
+	pattern = "CursorTabStatus",
+	modeline = false,
+	data = status,
+})
+`
+
+// statusSnapshot is what cursortab_status returns and User CursorTabStatus
+// carries.
+type statusSnapshot struct {
+	State         string `msgpack:"state"`
+	LastLatencyMs int64  `msgpack:"last_latency_ms"`
+	LastError     string `msgpack:"last_error"`
+	ErrorCategory string `msgpack:"error_category"`
+	LastErrorAt   int64  `msgpack:"last_error_at"`
+	Auth          string `msgpack:"auth"`
+	Reachable     bool   `msgpack:"reachable"`
+	Endpoint      string `msgpack:"endpoint"`
+	Model         string `msgpack:"model"`
+	Triggers      uint64 `msgpack:"triggers"`
+	Merged        uint64 `msgpack:"merged"`
+	Dropped       uint64 `msgpack:"dropped"`
+	Fired         uint64 `msgpack:"fired"`
+}
+
+// statusTracker follows whether a request is in flight or a suggestion is
+// waiting for tab, and calls changed whenever that moves.
+type statusTracker struct {
+	changed func()
+
+	mu          sync.Mutex
+	inflight    int
+	ready       bool
+	lastLatency time.Duration
+	model       string
+}
+
+func newStatusTracker(changed func()) *statusTracker {
+	return &statusTracker{changed: changed}
+}
+
+func (t *statusTracker) stateLocked() string {
+	switch {
+	case t.inflight > 0:
+		return statusRequesting
+	case t.ready:
+		return statusSuggestion
+	default:
+		return statusIdle
+	}
+}
+
+func (t *statusTracker) update(f func()) {
+	t.mu.Lock()
+	before := t.stateLocked()
+	f()
+	after := t.stateLocked()
+	t.mu.Unlock()
+
+	if before != after {
+		t.changed()
+	}
+}
+
+// requestStarted marks a request for model in flight, "" when the server
+// picks. The returned func marks it done, recording latency if it
+// succeeded.
+func (t *statusTracker) requestStarted(model string) func(ok bool) {
+	start := time.Now()
+	t.update(func() {
+		t.inflight++
+		t.model = model
+	})
+
+	return func(ok bool) {
+		t.update(func() {
+			t.inflight--
+			if ok {
+				t.lastLatency = time.Since(start)
+			}
+		})
+	}
+}
+
+func (t *statusTracker) suggestionReady(ready bool) {
+	t.update(func() { t.ready = ready })
+}
+
+func (t *statusTracker) snapshot() (string, time.Duration, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stateLocked(), t.lastLatency, t.model
+}
+
+func (s *state) statusSnapshot() *statusSnapshot {
+	state, latency, model := s.status.snapshot()
+	stats := s.scheduler.snapshot()
+	lastErr := s.reporter.lastError()
+	ep := s.endpoints.completions()
+
+	snapshot := &statusSnapshot{
+		State:         state,
+		LastLatencyMs: latency.Milliseconds(),
+		LastError:     lastErr.message,
+		ErrorCategory: string(lastErr.category),
+		Auth:          s.tokens.authState(),
+		Reachable:     ep.healthy.Load(),
+		Endpoint:      ep.url,
+		Model:         model,
+		Triggers:      stats.triggers,
+		Merged:        stats.merged,
+		Dropped:       stats.dropped,
+		Fired:         stats.fired,
+	}
+
+	if !lastErr.at.IsZero() {
+		snapshot.LastErrorAt = lastErr.at.UnixMilli()
+	}
+
+	return snapshot
+}
+
+// publishStatus sends the current snapshot to User CursorTabStatus.
+func (s *state) publishStatus() {
+	if err := s.v.ExecLua(statusPublishLua, nil, s.statusSnapshot()); err != nil {
+		log.Printf("error publishing status: %v", err)
+	}
+}
+
+func (s *state) registerStatus() error {
+	return s.v.RegisterHandler("cursortab_status", func(_ *nvim.Nvim) (*statusSnapshot, error) {
+		return s.statusSnapshot(), nil
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// suggestion replaces the buffer lines start..start+len(old) with lines.
+// Lines both sides agree on are trimmed off, so old and lines start and end
+// with the lines that actually change, and what's left can be accepted a
+// line or a word at a time.
+type suggestion struct {
+	start int
+	old   []string
+	lines []string
+
+	// jump is the 0 based line cursor prediction moved to before this
+	// suggestion was made, -1 if there was none.
+	jump int
+
+	// tick is the buffer's changedtick the suggestion was made against.
+	// Applying it to a buffer that has changed since is refused.
+	tick int
+
+	confidence *int32
+}
+
+// newSuggestion builds the suggestion replacing the 0 based lines
+// startLine..endLineInclusive of current with place.
+func newSuggestion(current []string, startLine, endLineInclusive int, place []string) *suggestion {
+	startLine = min(max(startLine, 0), len(current))
+	end := min(max(endLineInclusive+1, startLine), len(current))
+
+	sg := &suggestion{
+		start: startLine,
+		old:   append([]string(nil), current[startLine:end]...),
+		lines: append([]string(nil), place...),
+		jump:  -1,
+	}
+	sg.trim()
+
+	return sg
+}
+
+func (sg *suggestion) trim() {
+	for len(sg.old) > 0 && len(sg.lines) > 0 && sg.old[0] == sg.lines[0] {
+		sg.old, sg.lines = sg.old[1:], sg.lines[1:]
+		sg.start++
+	}
+
+	for len(sg.old) > 0 && len(sg.lines) > 0 && sg.old[len(sg.old)-1] == sg.lines[len(sg.lines)-1] {
+		sg.old, sg.lines = sg.old[:len(sg.old)-1], sg.lines[:len(sg.lines)-1]
+	}
+}
+
+// empty reports whether applying sg would change nothing.
+func (sg *suggestion) empty() bool {
+	return len(sg.old) == 0 && len(sg.lines) == 0
+}
+
+// appliedTo returns lines with sg applied.
+func (sg *suggestion) appliedTo(lines []string) []string {
+	start := min(sg.start, len(lines))
+	end := min(sg.start+len(sg.old), len(lines))
+
+	out := make([]string, 0, len(lines)-(end-start)+len(sg.lines))
+	out = append(out, lines[:start]...)
+	out = append(out, sg.lines...)
+	out = append(out, lines[end:]...)
+
+	return out
+}
+
+// acceptLine splits off the first changed line. accepted replaces it, rest
+// is everything after, nil if nothing is left.
+func (sg *suggestion) acceptLine() (accepted, rest *suggestion) {
+	nOld, nNew := min(1, len(sg.old)), min(1, len(sg.lines))
+
+	accepted = &suggestion{
+		start: sg.start,
+		old:   sg.old[:nOld],
+		lines: sg.lines[:nNew],
+		jump:  sg.jump,
+		tick:  sg.tick,
+	}
+
+	rest = &suggestion{
+		start:      sg.start + nNew,
+		old:        sg.old[nOld:],
+		lines:      sg.lines[nNew:],
+		jump:       -1,
+		confidence: sg.confidence,
+	}
+	rest.trim()
+
+	if rest.empty() {
+		return accepted, nil
+	}
+
+	return accepted, rest
+}
+
+// acceptWord splits off the next word typed into the first changed line.
+// Lines that aren't a plain insertion into the old line are accepted whole,
+// as acceptLine would.
+func (sg *suggestion) acceptWord() (accepted, rest *suggestion) {
+	if len(sg.lines) == 0 {
+		return sg.acceptLine()
+	}
+
+	var oldLine string
+	if len(sg.old) > 0 {
+		oldLine = sg.old[0]
+	}
+
+	partial, ok := nextWord(oldLine, sg.lines[0])
+	if !ok {
+		return sg.acceptLine()
+	}
+
+	nOld := min(1, len(sg.old))
+
+	accepted = &suggestion{
+		start: sg.start,
+		old:   sg.old[:nOld],
+		lines: []string{partial},
+		jump:  sg.jump,
+		tick:  sg.tick,
+	}
+
+	rest = &suggestion{
+		start:      sg.start,
+		old:        append([]string{partial}, sg.old[nOld:]...),
+		lines:      sg.lines,
+		jump:       -1,
+		confidence: sg.confidence,
+	}
+	rest.trim()
+
+	if rest.empty() {
+		return accepted, nil
+	}
+
+	return accepted, rest
+}
+
+// nextWord returns oldLine with the next word of what newLine inserts into
+// it typed in: leading spaces and then a run of letters and digits, or a
+// run of punctuation. ok is false if newLine isn't oldLine with text
+// inserted at one place, or if that word is all of the insertion.
+func nextWord(oldLine, newLine string) (string, bool) {
+	prefix := 0
+	for prefix < len(oldLine) && prefix < len(newLine) && oldLine[prefix] == newLine[prefix] {
+		prefix++
+	}
+	for prefix > 0 && !isRuneStart(newLine, prefix) {
+		prefix--
+	}
+
+	suffix := 0
+	for suffix < len(oldLine)-prefix && suffix < len(newLine)-prefix && oldLine[len(oldLine)-1-suffix] == newLine[len(newLine)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !isRuneStart(newLine, len(newLine)-suffix) {
+		suffix--
+	}
+
+	if prefix+suffix != len(oldLine) {
+		return "", false
+	}
+
+	inserted := newLine[prefix : len(newLine)-suffix]
+
+	i := 0
+	for i < len(inserted) {
+		r, size := utf8.DecodeRuneInString(inserted[i:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		i += size
+	}
+
+	if i < len(inserted) {
+		r, _ := utf8.DecodeRuneInString(inserted[i:])
+		word := isWordRune(r)
+
+		for i < len(inserted) {
+			r, size := utf8.DecodeRuneInString(inserted[i:])
+			if unicode.IsSpace(r) || isWordRune(r) != word {
+				break
+			}
+			i += size
+		}
+	}
+
+	if i >= len(inserted) {
+		return "", false
+	}
+
+	return oldLine[:prefix] + inserted[:i] + oldLine[prefix:], true
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// textEdit is a nvim_buf_set_text call: the 0 based, end exclusive byte
+// range startRow:startCol..endRow:endCol is replaced with lines.
+type textEdit struct {
+	startRow, startCol int
+	endRow, endCol     int
+	lines              []string
+
+	// cursorRow and cursorCol are the end of the inserted text.
+	cursorRow, cursorCol int
+}
+
+// textEdit returns the smallest edit that applies sg to buf, which must be
+// the lines sg was made against. Text the old and new lines share at either
+// end is left alone, so marks and extmarks on it stay where they are.
+func (sg *suggestion) textEdit(buf []string) textEdit {
+	oldText := strings.Join(sg.old, "\n")
+	newText := strings.Join(sg.lines, "\n")
+
+	startRow, startCol := sg.start, 0
+	switch {
+	case len(sg.old) == 0 && sg.start >= len(buf) && len(buf) > 0:
+		// appending past the last line, start from its end instead
+		startRow = len(buf) - 1
+		startCol = len(buf[startRow])
+		newText = "\n" + newText
+	case len(sg.old) == 0:
+		newText += "\n"
+	case len(sg.lines) == 0 && sg.start+len(sg.old) < len(buf):
+		oldText += "\n"
+	case len(sg.lines) == 0 && sg.start > 0:
+		// deleting through the last line, take the newline before it
+		startRow = sg.start - 1
+		startCol = len(buf[startRow])
+		oldText = "\n" + oldText
+	}
+
+	prefix := 0
+	for prefix < len(oldText) && prefix < len(newText) && oldText[prefix] == newText[prefix] {
+		prefix++
+	}
+	for prefix > 0 && !isRuneStart(newText, prefix) {
+		prefix--
+	}
+
+	suffix := 0
+	for suffix < len(oldText)-prefix && suffix < len(newText)-prefix && oldText[len(oldText)-1-suffix] == newText[len(newText)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !isRuneStart(newText, len(newText)-suffix) {
+		suffix--
+	}
+
+	edit := textEdit{lines: strings.Split(newText[prefix:len(newText)-suffix], "\n")}
+	edit.startRow, edit.startCol = advance(startRow, startCol, oldText[:prefix])
+	edit.endRow, edit.endCol = advance(startRow, startCol, oldText[:len(oldText)-suffix])
+	edit.cursorRow, edit.cursorCol = advance(edit.startRow, edit.startCol, newText[prefix:len(newText)-suffix])
+
+	// a trailing newline leaves the cursor at the start of the next line,
+	// keep it at the end of the last inserted one
+	if last := len(edit.lines) - 1; last > 0 && edit.lines[last] == "" {
+		edit.cursorRow--
+		edit.cursorCol = len(edit.lines[last-1])
+		if last == 1 {
+			edit.cursorCol += edit.startCol
+		}
+	}
+
+	return edit
+}
+
+// advance returns the position just past text written at row:col.
+func advance(row, col int, text string) (int, int) {
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		return row + strings.Count(text, "\n"), len(text) - i - 1
+	}
+
+	return row, col + len(text)
+}
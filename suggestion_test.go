@@ -0,0 +1,259 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// setText does to lines what nvim_buf_set_text does to a buffer.
+func setText(lines []string, e textEdit) []string {
+	replaced := slices.Clone(e.lines)
+	replaced[0] = lines[e.startRow][:e.startCol] + replaced[0]
+	replaced[len(replaced)-1] += lines[e.endRow][e.endCol:]
+
+	out := slices.Clone(lines[:e.startRow])
+	out = append(out, replaced...)
+	return append(out, lines[e.endRow+1:]...)
+}
+
+func TestTextEdit(t *testing.T) {
+	tests := []struct {
+		name       string
+		buf        []string
+		start, end int
+		place      []string
+		want       textEdit
+	}{
+		{
+			name: "word inside a line", buf: []string{"foo bar", "baz"},
+			start: 0, end: 0, place: []string{"foo qux"},
+			want: textEdit{startRow: 0, startCol: 4, endRow: 0, endCol: 7, lines: []string{"qux"}, cursorRow: 0, cursorCol: 7},
+		},
+		{
+			name: "insert a line", buf: []string{"a", "c"},
+			start: 1, end: 0, place: []string{"b"},
+			want: textEdit{startRow: 1, startCol: 0, endRow: 1, endCol: 0, lines: []string{"b", ""}, cursorRow: 1, cursorCol: 1},
+		},
+		{
+			name: "insert several lines", buf: []string{"a", "d"},
+			start: 1, end: 0, place: []string{"b", "c"},
+			want: textEdit{startRow: 1, startCol: 0, endRow: 1, endCol: 0, lines: []string{"b", "c", ""}, cursorRow: 2, cursorCol: 1},
+		},
+		{
+			name: "append past the last line", buf: []string{"a"},
+			start: 1, end: 0, place: []string{"b", "c"},
+			want: textEdit{startRow: 0, startCol: 1, endRow: 0, endCol: 1, lines: []string{"", "b", "c"}, cursorRow: 2, cursorCol: 1},
+		},
+		{
+			name: "delete a line", buf: []string{"a", "b", "c"},
+			start: 1, end: 1, place: nil,
+			want: textEdit{startRow: 1, startCol: 0, endRow: 2, endCol: 0, lines: []string{""}, cursorRow: 1, cursorCol: 0},
+		},
+		{
+			name: "delete through the last line", buf: []string{"a", "b", "c"},
+			start: 1, end: 2, place: nil,
+			want: textEdit{startRow: 0, startCol: 1, endRow: 2, endCol: 1, lines: []string{""}, cursorRow: 0, cursorCol: 1},
+		},
+		{
+			name: "delete the only line", buf: []string{"a"},
+			start: 0, end: 0, place: nil,
+			want: textEdit{startRow: 0, startCol: 0, endRow: 0, endCol: 1, lines: []string{""}, cursorRow: 0, cursorCol: 0},
+		},
+		{
+			name: "split a line", buf: []string{"foo", "bar"},
+			start: 0, end: 0, place: []string{"foo1", "foo2"},
+			want: textEdit{startRow: 0, startCol: 3, endRow: 0, endCol: 3, lines: []string{"1", "foo2"}, cursorRow: 1, cursorCol: 4},
+		},
+		{
+			name: "trailing newline keeps the cursor on the edited line", buf: []string{"abc"},
+			start: 0, end: 0, place: []string{"abX", "c"},
+			want: textEdit{startRow: 0, startCol: 2, endRow: 0, endCol: 2, lines: []string{"X", ""}, cursorRow: 0, cursorCol: 3},
+		},
+		{
+			name: "runes sharing leading bytes", buf: []string{"héllo wörld"},
+			start: 0, end: 0, place: []string{"héllo wørld"},
+			want: textEdit{startRow: 0, startCol: 8, endRow: 0, endCol: 10, lines: []string{"ø"}, cursorRow: 0, cursorCol: 10},
+		},
+		{
+			name: "runes sharing trailing bytes", buf: []string{"xΩ"},
+			start: 0, end: 0, place: []string{"xé"},
+			want: textEdit{startRow: 0, startCol: 1, endRow: 0, endCol: 3, lines: []string{"é"}, cursorRow: 0, cursorCol: 3},
+		},
+		{
+			name: "across lines", buf: []string{"one", "two", "three"},
+			start: 0, end: 2, place: []string{"one", "2", "three"},
+			want: textEdit{startRow: 1, startCol: 0, endRow: 1, endCol: 3, lines: []string{"2"}, cursorRow: 1, cursorCol: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sg := newSuggestion(tt.buf, tt.start, tt.end, tt.place)
+
+			got := sg.textEdit(tt.buf)
+			if got.startRow != tt.want.startRow || got.startCol != tt.want.startCol ||
+				got.endRow != tt.want.endRow || got.endCol != tt.want.endCol ||
+				!slices.Equal(got.lines, tt.want.lines) ||
+				got.cursorRow != tt.want.cursorRow || got.cursorCol != tt.want.cursorCol {
+				t.Errorf("textEdit() = %+v, want %+v", got, tt.want)
+			}
+
+			want := sg.appliedTo(tt.buf)
+			if len(want) == 0 {
+				// a buffer always keeps one line
+				want = []string{""}
+			}
+			if applied := setText(tt.buf, got); !slices.Equal(applied, want) {
+				t.Errorf("applying the edit = %q, want %q", applied, want)
+			}
+		})
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	tests := []struct {
+		text             string
+		wantRow, wantCol int
+	}{
+		{text: "", wantRow: 2, wantCol: 3},
+		{text: "abc", wantRow: 2, wantCol: 6},
+		{text: "é", wantRow: 2, wantCol: 5},
+		{text: "ab\n", wantRow: 3, wantCol: 0},
+		{text: "ab\ncd\nxyz", wantRow: 4, wantCol: 3},
+	}
+
+	for _, tt := range tests {
+		row, col := advance(2, 3, tt.text)
+		if row != tt.wantRow || col != tt.wantCol {
+			t.Errorf("advance(2, 3, %q) = %d, %d, want %d, %d", tt.text, row, col, tt.wantRow, tt.wantCol)
+		}
+	}
+}
+
+func TestAcceptParts(t *testing.T) {
+	tests := []struct {
+		name       string
+		buf        []string
+		start, end int
+		place      []string
+		split      func(*suggestion) (accepted, rest *suggestion)
+		want       [][]string
+	}{
+		{
+			name: "lines of an insertion", buf: []string{"a", "d"},
+			start: 1, end: 0, place: []string{"b", "c"},
+			split: (*suggestion).acceptLine,
+			want:  [][]string{{"a", "b", "d"}, {"a", "b", "c", "d"}},
+		},
+		{
+			name: "lines of a deletion", buf: []string{"a", "b", "c", "d"},
+			start: 1, end: 2, place: nil,
+			split: (*suggestion).acceptLine,
+			want:  [][]string{{"a", "c", "d"}, {"a", "d"}},
+		},
+		{
+			name: "replaced line then a deleted one", buf: []string{"a", "x", "y"},
+			start: 1, end: 2, place: []string{"X"},
+			split: (*suggestion).acceptLine,
+			want:  [][]string{{"a", "X", "y"}, {"a", "X"}},
+		},
+		{
+			name: "multi-byte line", buf: []string{"é"},
+			start: 0, end: 0, place: []string{"é漢字"},
+			split: (*suggestion).acceptLine,
+			want:  [][]string{{"é漢字"}},
+		},
+		{
+			name: "words then punctuation", buf: []string{"foo()"},
+			start: 0, end: 0, place: []string{"foo(bar, baz)"},
+			split: (*suggestion).acceptWord,
+			want:  [][]string{{"foo(bar)"}, {"foo(bar,)"}, {"foo(bar, baz)"}},
+		},
+		{
+			name: "multi-byte words", buf: []string{"x = "},
+			start: 0, end: 0, place: []string{"x = héllo wörld"},
+			split: (*suggestion).acceptWord,
+			want:  [][]string{{"x = héllo"}, {"x = héllo wörld"}},
+		},
+		{
+			name: "words of an inserted line", buf: []string{"a"},
+			start: 1, end: 0, place: []string{"hello world", "b"},
+			split: (*suggestion).acceptWord,
+			want:  [][]string{{"a", "hello"}, {"a", "hello world"}, {"a", "hello world", "b"}},
+		},
+		{
+			name: "rewritten line is taken whole", buf: []string{"foo"},
+			start: 0, end: 0, place: []string{"bar"},
+			split: (*suggestion).acceptWord,
+			want:  [][]string{{"bar"}},
+		},
+		{
+			name: "deletion is taken a line at a time", buf: []string{"a", "b", "c"},
+			start: 1, end: 2, place: nil,
+			split: (*suggestion).acceptWord,
+			want:  [][]string{{"a", "c"}, {"a"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sg := newSuggestion(tt.buf, tt.start, tt.end, tt.place)
+			final := sg.appliedTo(tt.buf)
+			buf := tt.buf
+
+			for i, want := range tt.want {
+				if sg == nil {
+					t.Fatalf("nothing left after %d accepts, want %d", i, len(tt.want))
+				}
+
+				accepted, rest := tt.split(sg)
+				buf = accepted.appliedTo(buf)
+				if !slices.Equal(buf, want) {
+					t.Fatalf("after accept %d buffer = %q, want %q", i+1, buf, want)
+				}
+
+				// what's left still leads to the whole suggestion
+				if rest != nil {
+					if got := rest.appliedTo(buf); !slices.Equal(got, final) {
+						t.Fatalf("after accept %d rest gives %q, want %q", i+1, got, final)
+					}
+				} else if !slices.Equal(buf, final) {
+					t.Fatalf("rest is empty after accept %d with %q, want %q", i+1, buf, final)
+				}
+
+				sg = rest
+			}
+
+			if sg != nil {
+				t.Errorf("rest = %+v after the last accept, want nil", sg)
+			}
+		})
+	}
+}
+
+func TestNextWord(t *testing.T) {
+	tests := []struct {
+		name             string
+		oldLine, newLine string
+		want             string
+		wantOK           bool
+	}{
+		{name: "word", oldLine: "foo()", newLine: "foo(bar, baz)", want: "foo(bar)", wantOK: true},
+		{name: "punctuation", oldLine: "a", newLine: "a+=1", want: "a+=", wantOK: true},
+		{name: "leading spaces", oldLine: "héllo", newLine: "héllo wörld!", want: "héllo wörld", wantOK: true},
+		{name: "runes sharing leading bytes", oldLine: "aé", newLine: "aè é", want: "aèé", wantOK: true},
+		{name: "word is the whole insertion", oldLine: "", newLine: "  indent"},
+		{name: "single rune insertion", oldLine: "ab", newLine: "a€b"},
+		{name: "not an insertion", oldLine: "abc", newLine: "xyz"},
+		{name: "deletion", oldLine: "abc", newLine: "ac"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nextWord(tt.oldLine, tt.newLine)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("nextWord(%q, %q) = %q, %v, want %q, %v", tt.oldLine, tt.newLine, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
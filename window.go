@@ -0,0 +1,96 @@
+package main
+
+import "strings"
+
+// contentWindow is the 0 based, half open range of buffer lines sent as the
+// current file. Everything sent with the file, the cursor, diagnostics and
+// the range the server answers with, is relative to start.
+type contentWindow struct {
+	start int
+	end   int
+	total int
+}
+
+// windowAround returns the lines within above and below of line, or the
+// whole buffer if it has no more than threshold lines. A threshold of 0
+// turns windowing off.
+func windowAround(total, line, above, below, threshold int) contentWindow {
+	if threshold <= 0 || total <= threshold {
+		return contentWindow{start: 0, end: total, total: total}
+	}
+
+	return contentWindow{
+		start: max(0, line-above),
+		end:   min(total, line+below+1),
+		total: total,
+	}
+}
+
+func (w contentWindow) contents(lines []string) string {
+	return strings.Join(lines[w.start:w.end], "\n")
+}
+
+// relative converts a 0 based buffer line into one relative to the window.
+func (w contentWindow) relative(line int) int {
+	return line - w.start
+}
+
+// absolute converts a 0 based line relative to the window back into a
+// buffer line.
+func (w contentWindow) absolute(line int) int {
+	return line + w.start
+}
+
+// replaced converts the 1 based, inclusive line range the server answers
+// with into 0 based buffer lines.
+func (w contentWindow) replaced(start, endInclusive int32) (int, int) {
+	return w.absolute(int(start - 1)), w.absolute(int(endInclusive - 1))
+}
+
+// clampEnd moves an end position past the window to the end of its last
+// line.
+func (w contentWindow) clampEnd(lines []string, lnum, col int) (int, int) {
+	if lnum < w.end {
+		return lnum, col
+	}
+
+	return w.end - 1, len(lines[w.end-1])
+}
+
+// diagnostics keeps the diagnostics that start inside the window, shifted
+// to be relative to it. Their related ranges are shifted the same way, and
+// dropped if they start outside the window. Ranges running past the end are
+// cut off at the end of the window's last line.
+func (w contentWindow) diagnostics(lines []string, diags []diagnostic) []diagnostic {
+	if w.start == 0 && w.end == w.total {
+		return diags
+	}
+
+	var out []diagnostic
+	for _, d := range diags {
+		if d.Lnum < w.start || d.Lnum >= w.end {
+			continue
+		}
+
+		d.EndLnum, d.EndCol = w.clampEnd(lines, d.EndLnum, d.EndCol)
+		d.Lnum = w.relative(d.Lnum)
+		d.EndLnum = w.relative(d.EndLnum)
+
+		var related []relatedDiagnostic
+		for _, r := range d.Related {
+			if r.Lnum < w.start || r.Lnum >= w.end {
+				continue
+			}
+
+			r.EndLnum, r.EndCol = w.clampEnd(lines, r.EndLnum, r.EndCol)
+			r.Lnum = w.relative(r.Lnum)
+			r.EndLnum = w.relative(r.EndLnum)
+			related = append(related, r)
+		}
+		d.Related = related
+
+		out = append(out, d)
+	}
+
+	return out
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestWindowAround(t *testing.T) {
+	tests := []struct {
+		name                                 string
+		total, line, above, below, threshold int
+		want                                 contentWindow
+	}{
+		{name: "windowing off", total: 500, line: 250, above: 10, below: 20, threshold: 0, want: contentWindow{0, 500, 500}},
+		{name: "short buffer", total: 100, line: 50, above: 10, below: 20, threshold: 100, want: contentWindow{0, 100, 100}},
+		{name: "middle", total: 500, line: 250, above: 10, below: 20, threshold: 100, want: contentWindow{240, 271, 500}},
+		{name: "near the start", total: 500, line: 3, above: 10, below: 20, threshold: 100, want: contentWindow{0, 24, 500}},
+		{name: "near the end", total: 500, line: 495, above: 10, below: 20, threshold: 100, want: contentWindow{485, 500, 500}},
+		{name: "last line", total: 500, line: 499, above: 10, below: 0, threshold: 100, want: contentWindow{489, 500, 500}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := windowAround(tt.total, tt.line, tt.above, tt.below, tt.threshold); got != tt.want {
+				t.Errorf("windowAround() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentWindowLines(t *testing.T) {
+	lines := make([]string, 30)
+	for i := range lines {
+		lines[i] = fmt.Sprint(i)
+	}
+
+	w := windowAround(len(lines), 12, 2, 3, 10)
+	if got, want := w.contents(lines), "10\n11\n12\n13\n14\n15"; got != want {
+		t.Errorf("contents() = %q, want %q", got, want)
+	}
+
+	for line := w.start; line < w.end; line++ {
+		if got := w.absolute(w.relative(line)); got != line {
+			t.Errorf("absolute(relative(%d)) = %d", line, got)
+		}
+	}
+	if got := w.relative(12); got != 2 {
+		t.Errorf("relative(12) = %d, want 2", got)
+	}
+
+	// the server's range is 1 based and counts from the window's first line
+	start, endInc := w.replaced(3, 4)
+	if start != 12 || endInc != 13 {
+		t.Errorf("replaced(3, 4) = %d, %d, want 12, 13", start, endInc)
+	}
+	if got := lines[start]; got != "12" {
+		t.Errorf("first replaced line = %q, want the cursor line", got)
+	}
+
+	whole := windowAround(len(lines), 12, 2, 3, 0)
+	if start, endInc := whole.replaced(1, 30); start != 0 || endInc != 29 {
+		t.Errorf("unwindowed replaced(1, 30) = %d, %d, want 0, 29", start, endInc)
+	}
+}
+
+func TestContentWindowDiagnostics(t *testing.T) {
+	w := contentWindow{start: 10, end: 20, total: 100}
+
+	lines := make([]string, 100)
+	lines[19] = "last line"
+
+	diags := []diagnostic{
+		{Lnum: 5, EndLnum: 5, Message: "before"},
+		{Lnum: 12, Col: 1, EndLnum: 25, EndCol: 2, Message: "runs past the end", Related: []relatedDiagnostic{
+			{Message: "inside", Lnum: 15, Col: 3, EndLnum: 16, EndCol: 4},
+			{Message: "above", Lnum: 2, EndLnum: 2},
+			{Message: "clamped", Lnum: 19, EndLnum: 30, EndCol: 1},
+		}},
+		{Lnum: 20, EndLnum: 20, Message: "after"},
+	}
+
+	want := []diagnostic{
+		{Lnum: 2, Col: 1, EndLnum: 9, EndCol: len("last line"), Message: "runs past the end", Related: []relatedDiagnostic{
+			{Message: "inside", Lnum: 5, Col: 3, EndLnum: 6, EndCol: 4},
+			{Message: "clamped", Lnum: 9, EndLnum: 9, EndCol: len("last line")},
+		}},
+	}
+
+	if got := w.diagnostics(lines, diags); !reflect.DeepEqual(got, want) {
+		t.Errorf("diagnostics() = %+v, want %+v", got, want)
+	}
+
+	if diags[1].Related[0].Lnum != 15 {
+		t.Errorf("diagnostics() modified its input")
+	}
+
+	whole := contentWindow{start: 0, end: 100, total: 100}
+	if got := whole.diagnostics(lines, diags); !reflect.DeepEqual(got, diags) {
+		t.Errorf("unwindowed diagnostics() = %+v, want them unchanged", got)
+	}
+}
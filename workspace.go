@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// workspaceLua finds the workspace root of a buffer, trying the enclosing
+// git repository, then the root_dir of an attached LSP client, then the
+// current directory, and reports the buffer's filetype along with it. A
+// root found before is passed back in and used as is.
+const workspaceLua = `
+local bufnr, cached = ...
+if cached ~= "" then
+	return { root = cached, filetype = vim.bo[bufnr].filetype, detected = true }
+end
+
+local name = vim.api.nvim_buf_get_name(bufnr)
+local root
+
+if name ~= "" then
+	local git = vim.fs.find(".git", { upward = true, path = vim.fs.dirname(name) })[1]
+	if git then
+		root = vim.fs.dirname(git)
+	end
+end
+
+if not root then
+	for _, client in ipairs(vim.lsp.get_clients({ bufnr = bufnr })) do
+		if client.config.root_dir then
+			root = client.config.root_dir
+			break
+		end
+	end
+end
+
+return { root = root or vim.fn.getcwd(), filetype = vim.bo[bufnr].filetype, detected = root ~= nil }
+`
+
+// workspace is the root a buffer's paths are sent relative to.
+type workspace struct {
+	Root     string `msgpack:"root"`
+	Filetype string `msgpack:"filetype"`
+
+	// Detected is false when the root is only the current directory.
+	Detected bool `msgpack:"detected"`
+}
+
+// bufferWorkspace detects the workspace of b. A root found from git or LSP
+// is cached until the buffer is renamed or unloaded; the current directory
+// fallback isn't, so a language server attaching later is still noticed.
+func (s *state) bufferWorkspace(b *buffer) (workspace, error) {
+	cached := s.buffers.workspaceRoot(b.id, b.path)
+
+	var ws workspace
+	if err := s.v.ExecLua(workspaceLua, &ws, b.id, cached); err != nil {
+		return workspace{}, err
+	}
+
+	if cached == "" && ws.Detected {
+		s.buffers.setWorkspaceRoot(b.id, b.path, ws.Root)
+	}
+
+	return ws, nil
+}
+
+// relative returns path relative to the workspace root. Paths outside the
+// root, or any path if the root is unknown, are returned unchanged.
+func (ws workspace) relative(path string) string {
+	if ws.Root == "" || !filepath.IsAbs(path) {
+		return path
+	}
+
+	rel, err := filepath.Rel(ws.Root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// languageIDs maps Neovim filetypes to the VS Code language ids the server
+// knows, where the two differ.
+var languageIDs = map[string]string{
+	"":            "plaintext",
+	"text":        "plaintext",
+	"sh":          "shellscript",
+	"bash":        "shellscript",
+	"zsh":         "shellscript",
+	"cs":          "csharp",
+	"make":        "makefile",
+	"objc":        "objective-c",
+	"objcpp":      "objective-cpp",
+	"tex":         "latex",
+	"plaintex":    "tex",
+	"vim":         "viml",
+	"gitcommit":   "git-commit",
+	"gitrebase":   "git-rebase",
+	"gomod":       "go.mod",
+	"gosum":       "go.sum",
+	"dosini":      "ini",
+	"ps1":         "powershell",
+	"jproperties": "properties",
+	"help":        "plaintext",
+}
+
+// languageID maps a filetype to a VS Code language id. Most filetypes
+// (go, python, rust, typescriptreact, ...) are already the same. Compound
+// filetypes like "javascript.jsx" use their first part.
+func languageID(filetype string) string {
+	filetype, _, _ = strings.Cut(filetype, ".")
+
+	if id, ok := languageIDs[filetype]; ok {
+		return id
+	}
+
+	return filetype
+}
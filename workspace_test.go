@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+func TestLanguageID(t *testing.T) {
+	tests := []struct {
+		filetype, want string
+	}{
+		{"go", "go"},
+		{"typescriptreact", "typescriptreact"},
+		{"", "plaintext"},
+		{"sh", "shellscript"},
+		{"cs", "csharp"},
+		{"gomod", "go.mod"},
+		{"javascript.jsx", "javascript"},
+		{"sh.bats", "shellscript"},
+	}
+
+	for _, tt := range tests {
+		if got := languageID(tt.filetype); got != tt.want {
+			t.Errorf("languageID(%q) = %q, want %q", tt.filetype, got, tt.want)
+		}
+	}
+}
+
+func TestWorkspaceRelative(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("paths below are unix paths")
+	}
+
+	tests := []struct {
+		name, root, path, want string
+	}{
+		{name: "inside", root: "/ws", path: "/ws/pkg/a.go", want: "pkg/a.go"},
+		{name: "trailing slash root", root: "/ws/", path: "/ws/a.go", want: "a.go"},
+		{name: "outside", root: "/ws", path: "/other/a.go", want: "/other/a.go"},
+		{name: "sibling with a shared prefix", root: "/ws", path: "/ws2/a.go", want: "/ws2/a.go"},
+		{name: "dot dot named file", root: "/ws", path: "/ws/..a.go", want: "..a.go"},
+		{name: "unknown root", root: "", path: "/ws/a.go", want: "/ws/a.go"},
+		{name: "relative path", root: "/ws", path: "a.go", want: "a.go"},
+		{name: "the root itself", root: "/ws", path: "/ws", want: "."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (workspace{Root: tt.root}).relative(tt.path); got != filepath.ToSlash(tt.want) {
+				t.Errorf("relative(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkspaceRootCache(t *testing.T) {
+	r := newBufferRegistry()
+	id := nvim.Buffer(1)
+
+	if got := r.workspaceRoot(id, "/ws/a.go"); got != "" {
+		t.Errorf("workspaceRoot() before detection = %q", got)
+	}
+
+	r.setWorkspaceRoot(id, "/ws/a.go", "/ws")
+	if got := r.workspaceRoot(id, "/ws/a.go"); got != "/ws" {
+		t.Errorf("workspaceRoot() = %q, want /ws", got)
+	}
+	if got := r.workspaceRoot(nvim.Buffer(2), "/ws/a.go"); got != "" {
+		t.Errorf("workspaceRoot() of another buffer = %q", got)
+	}
+	if got := r.workspaceRoot(id, "/other/a.go"); got != "" {
+		t.Errorf("workspaceRoot() after a rename = %q", got)
+	}
+
+	r.onDetach(id)
+	if got := r.workspaceRoot(id, "/ws/a.go"); got != "" {
+		t.Errorf("workspaceRoot() after detach = %q", got)
+	}
+}
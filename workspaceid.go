@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// workspaceIDs hands out a stable UUID per workspace root, persisted in a
+// small JSON file so the same project keeps its id across sessions.
+type workspaceIDs struct {
+	path string
+
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+func newWorkspaceIDs(path string) *workspaceIDs {
+	return &workspaceIDs{path: path, ids: map[string]string{}}
+}
+
+// workspaceIDsPath returns where workspace ids are kept,
+// $XDG_STATE_HOME/cursortab/workspaces.json by default.
+func workspaceIDsPath() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = os.Getenv("HOME")
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(dir, "cursortab", "workspaces.json")
+}
+
+// get returns the id of the workspace at root, creating and persisting one
+// the first time root is seen. If the file can't be read or written the id
+// is still kept for the rest of the session, but a file that can't be read
+// is left alone rather than replaced with only this session's ids. An
+// unknown root, "", has no id.
+func (w *workspaceIDs) get(root string) string {
+	if root == "" {
+		return ""
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if id, ok := w.ids[root]; ok {
+		return id
+	}
+
+	// another Neovim may have assigned one since we last looked
+	loadErr := w.loadLocked()
+	if loadErr != nil {
+		log.Printf("error loading workspace ids: %v", loadErr)
+	}
+
+	if id, ok := w.ids[root]; ok {
+		return id
+	}
+
+	id := uuid.NewString()
+	w.ids[root] = id
+
+	if loadErr != nil {
+		log.Printf("not saving workspace ids over %s", w.path)
+		return id
+	}
+
+	if err := w.saveLocked(); err != nil {
+		log.Printf("error saving workspace ids: %v", err)
+	}
+
+	return id
+}
+
+// field returns the id of the workspace at root for a request, nil if
+// the root is unknown.
+func (w *workspaceIDs) field(root string) *string {
+	id := w.get(root)
+	if id == "" {
+		return nil
+	}
+
+	return &id
+}
+
+// loadLocked merges the ids on disk into the ones already known.
+func (w *workspaceIDs) loadLocked() error {
+	raw, err := os.ReadFile(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var ids map[string]string
+	if err := json.Unmarshal(raw, &ids); err != nil {
+		return fmt.Errorf("error parsing %s: %w", w.path, err)
+	}
+
+	for root, id := range ids {
+		w.ids[root] = id
+	}
+
+	return nil
+}
+
+// saveLocked writes the ids to a temporary file and renames it into place,
+// so a crash never leaves a half written file behind.
+func (w *workspaceIDs) saveLocked() error {
+	raw, err := json.MarshalIndent(w.ids, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(w.path), 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), ".workspaces-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), w.path)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkspaceIDsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursortab", "workspaces.json")
+
+	first := newWorkspaceIDs(path).get("/src/a")
+	if first == "" {
+		t.Fatal("get() returned no id")
+	}
+
+	ids := newWorkspaceIDs(path)
+	if got := ids.get("/src/a"); got != first {
+		t.Errorf("get() after reload = %q, want %q", got, first)
+	}
+	if got := ids.get("/src/b"); got == first || got == "" {
+		t.Errorf("get() for another root = %q", got)
+	}
+}
+
+func TestWorkspaceIDsKeepUnreadableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workspaces.json")
+	corrupt := []byte(`{"/src/a": "id-a",`)
+	if err := os.WriteFile(path, corrupt, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := newWorkspaceIDs(path)
+
+	id := ids.get("/src/b")
+	if id == "" {
+		t.Fatal("get() returned no id")
+	}
+	if got := ids.get("/src/b"); got != id {
+		t.Errorf("get() = %q, want the same id %q for the session", got, id)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != string(corrupt) {
+		t.Errorf("workspaces.json was overwritten with %s", raw)
+	}
+}
+
+func TestWorkspaceIDsEmptyRoot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workspaces.json")
+	ids := newWorkspaceIDs(path)
+
+	if got := ids.get(""); got != "" {
+		t.Errorf("get(\"\") = %q, want no id", got)
+	}
+	if got := ids.field(""); got != nil {
+		t.Errorf("field(\"\") = %q, want nil", *got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("workspaces.json written for an empty root: %v", err)
+	}
+}